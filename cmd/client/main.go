@@ -2,15 +2,20 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"firecast/pkg/structs"
@@ -18,11 +23,69 @@ import (
 	"github.com/joho/godotenv"
 )
 
+// errVideoCancelled is returned when the server reports that the video was cancelled
+var errVideoCancelled = errors.New("video was cancelled")
+
+// videoError is a processing failure together with the stage it happened in
+// and whether retrying it could help
+type videoError struct {
+	stage string
+	class string
+	err   error
+}
+
+func (e *videoError) Error() string {
+	return e.err.Error()
+}
+
+// httpStatusError is returned when AzuraCast or the server answers with a non-OK status
+type httpStatusError struct {
+	statusCode int
+	message    string
+}
+
+func (e *httpStatusError) Error() string {
+	return e.message
+}
+
+// permanentDownloadErrors are yt-dlp messages that will not go away on retry
+var permanentDownloadErrors = []string{
+	"Video unavailable",
+	"Private video",
+	"This video has been removed",
+	"copyright",
+	"Unsupported URL",
+	"account associated with this video has been terminated",
+}
+
+// classifyError decides whether a failed stage is worth retrying
+func classifyError(err error) string {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		// Client errors other than timeouts and rate limits will fail again
+		if statusErr.statusCode >= 400 && statusErr.statusCode < 500 &&
+			statusErr.statusCode != http.StatusRequestTimeout && statusErr.statusCode != http.StatusTooManyRequests {
+			return structs.ClassPermanent
+		}
+		return structs.ClassTransient
+	}
+
+	for _, message := range permanentDownloadErrors {
+		if strings.Contains(err.Error(), message) {
+			return structs.ClassPermanent
+		}
+	}
+	return structs.ClassTransient
+}
+
 type VideoProcessor struct {
-	azuraCastAPIKey string
-	azuraCastDomain string
-	serverURL       string
-	fireCastSecret  string
+	azuraCastAPIKey   string
+	azuraCastDomain   string
+	serverURL         string
+	fireCastSecret    string
+	heartbeatInterval time.Duration
+	pollWait          time.Duration
+	workerName        string
 }
 
 func NewVideoProcessor() (*VideoProcessor, error) {
@@ -44,20 +107,50 @@ func NewVideoProcessor() (*VideoProcessor, error) {
 		serverURL = "http://localhost:8080"
 	}
 
+	heartbeatIntervalStr := os.Getenv("HEARTBEAT_INTERVAL")
+	if heartbeatIntervalStr == "" {
+		heartbeatIntervalStr = "30"
+	}
+	heartbeatInterval, err := strconv.Atoi(heartbeatIntervalStr)
+	if err != nil || heartbeatInterval <= 0 {
+		log.Printf("Invalid HEARTBEAT_INTERVAL value: %s, using default 30", heartbeatIntervalStr)
+		heartbeatInterval = 30
+	}
+
+	// POLL_WAIT is how long the server holds /video/get open while the queue is empty
+	pollWaitStr := os.Getenv("POLL_WAIT")
+	if pollWaitStr == "" {
+		pollWaitStr = "30"
+	}
+	pollWait, err := strconv.Atoi(pollWaitStr)
+	if err != nil || pollWait < 0 {
+		log.Printf("Invalid POLL_WAIT value: %s, using default 30", pollWaitStr)
+		pollWait = 30
+	}
+
+	// WORKER_NAME identifies this worker in the event log of the videos it claims
+	workerName := os.Getenv("WORKER_NAME")
+	if workerName == "" {
+		workerName, _ = os.Hostname()
+	}
+
 	return &VideoProcessor{
-		azuraCastAPIKey: azuraCastAPIKey,
-		azuraCastDomain: azuraCastDomain,
-		serverURL:       serverURL,
-		fireCastSecret:  fireCastSecret,
+		azuraCastAPIKey:   azuraCastAPIKey,
+		azuraCastDomain:   azuraCastDomain,
+		serverURL:         serverURL,
+		fireCastSecret:    fireCastSecret,
+		heartbeatInterval: time.Duration(heartbeatInterval) * time.Second,
+		pollWait:          time.Duration(pollWait) * time.Second,
+		workerName:        workerName,
 	}, nil
 }
 
-func (vp *VideoProcessor) downloadVideoAsMP3(videoURL string) (string, error) {
+func (vp *VideoProcessor) downloadVideoAsMP3(ctx context.Context, videoURL string) (string, error) {
 	if err := os.MkdirAll("downloads", 0755); err != nil {
 		return "", fmt.Errorf("failed to create downloads directory: %v", err)
 	}
 
-	cmd := exec.Command("yt-dlp",
+	cmd := exec.CommandContext(ctx, "yt-dlp",
 		"--format", "bestaudio/best",
 		"--extract-audio",
 		"--audio-format", "mp3",
@@ -102,7 +195,26 @@ func (vp *VideoProcessor) downloadVideoAsMP3(videoURL string) (string, error) {
 	return newestFile, nil
 }
 
-func (vp *VideoProcessor) uploadToAzuraCast(localFile string) (int, error) {
+// listPlaylistEntries returns the video ids of a YouTube playlist without downloading anything
+func (vp *VideoProcessor) listPlaylistEntries(ctx context.Context, playlistURL string) ([]string, error) {
+	cmd := exec.CommandContext(ctx, "yt-dlp",
+		"--flat-playlist",
+		"--print", "id",
+		playlistURL,
+	)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("yt-dlp failed: %v, stderr: %s", err, stderr.String())
+	}
+
+	return strings.Fields(stdout.String()), nil
+}
+
+func (vp *VideoProcessor) uploadToAzuraCast(ctx context.Context, localFile string) (int, error) {
 	apiURL := fmt.Sprintf("https://%s/api/station/1/files", vp.azuraCastDomain)
 
 	fileContent, err := os.ReadFile(localFile)
@@ -122,7 +234,7 @@ func (vp *VideoProcessor) uploadToAzuraCast(localFile string) (int, error) {
 		return 0, fmt.Errorf("failed to marshal JSON: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", apiURL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return 0, fmt.Errorf("failed to create request: %v", err)
 	}
@@ -143,7 +255,10 @@ func (vp *VideoProcessor) uploadToAzuraCast(localFile string) (int, error) {
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return 0, fmt.Errorf("AzuraCast API upload error: %d %s", resp.StatusCode, string(body))
+		return 0, &httpStatusError{
+			statusCode: resp.StatusCode,
+			message:    fmt.Sprintf("AzuraCast API upload error: %d %s", resp.StatusCode, string(body)),
+		}
 	}
 
 	var response map[string]interface{}
@@ -160,7 +275,7 @@ func (vp *VideoProcessor) uploadToAzuraCast(localFile string) (int, error) {
 	return int(songID), nil
 }
 
-func (vp *VideoProcessor) assignPlaylistToSong(songID, playlistID int) error {
+func (vp *VideoProcessor) assignPlaylistToSong(ctx context.Context, songID, playlistID int) error {
 	apiURL := fmt.Sprintf("https://%s/api/station/1/file/%d", vp.azuraCastDomain, songID)
 
 	data := map[string]interface{}{
@@ -175,7 +290,7 @@ func (vp *VideoProcessor) assignPlaylistToSong(songID, playlistID int) error {
 		return fmt.Errorf("failed to marshal JSON: %v", err)
 	}
 
-	req, err := http.NewRequest("PUT", apiURL, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "PUT", apiURL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %v", err)
 	}
@@ -196,21 +311,28 @@ func (vp *VideoProcessor) assignPlaylistToSong(songID, playlistID int) error {
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("AzuraCast API playlist assignment error: %d %s", resp.StatusCode, string(body))
+		return &httpStatusError{
+			statusCode: resp.StatusCode,
+			message:    fmt.Sprintf("AzuraCast API playlist assignment error: %d %s", resp.StatusCode, string(body)),
+		}
 	}
 
 	return nil
 }
 
 func (vp *VideoProcessor) getNextVideo() (*structs.VideoResponse, error) {
-	req, err := http.NewRequest("GET", vp.serverURL+"/video/get", nil)
+	query := url.Values{}
+	query.Set("worker", vp.workerName)
+	query.Set("wait", vp.pollWait.String())
+	req, err := http.NewRequest("GET", vp.serverURL+"/video/get?"+query.Encode(), nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
 
 	req.Header.Set("Authorization", "Bearer "+vp.fireCastSecret)
 
-	client := &http.Client{Timeout: 10 * time.Second}
+	// The server holds the request open for up to pollWait while the queue is empty
+	client := &http.Client{Timeout: vp.pollWait + 10*time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %v", err)
@@ -238,8 +360,83 @@ func (vp *VideoProcessor) getNextVideo() (*structs.VideoResponse, error) {
 	return &video, nil
 }
 
-func (vp *VideoProcessor) markVideoComplete(uuid string) error {
-	data := structs.VideoDoneRequest{Uuid: uuid}
+// sendHeartbeat extends the lease on a video. A non-empty stage also reports
+// that the worker just started that stage.
+func (vp *VideoProcessor) sendHeartbeat(uuid, token, stage string) error {
+	data := structs.VideoHeartbeatRequest{Uuid: uuid, Token: token, Stage: stage}
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON: %v", err)
+	}
+
+	req, err := http.NewRequest("POST", vp.serverURL+"/video/heartbeat", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+vp.fireCastSecret)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Printf("Warning: failed to close response body: %v", err)
+		}
+	}()
+
+	if resp.StatusCode == http.StatusGone {
+		return errVideoCancelled
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("server error: %d %s", resp.StatusCode, string(body))
+	}
+
+	return nil
+}
+
+// startHeartbeat keeps the lease on a video alive until the returned stop function
+// is called. If the video gets cancelled on the server, cancel is called.
+func (vp *VideoProcessor) startHeartbeat(uuid, token string, cancel context.CancelFunc) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(vp.heartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := vp.sendHeartbeat(uuid, token, "")
+				if err == errVideoCancelled {
+					log.Printf("Video %s was cancelled, stopping", uuid)
+					cancel()
+					return
+				}
+				if err != nil {
+					log.Printf("Warning: heartbeat for video %s failed: %v", uuid, err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func (vp *VideoProcessor) markVideoComplete(uuid, token string) error {
+	data := structs.VideoDoneRequest{Uuid: uuid, Token: token}
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		return fmt.Errorf("failed to marshal JSON: %v", err)
@@ -264,6 +461,10 @@ func (vp *VideoProcessor) markVideoComplete(uuid string) error {
 		}
 	}()
 
+	if resp.StatusCode == http.StatusGone {
+		return errVideoCancelled
+	}
+
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		return fmt.Errorf("server error: %d %s", resp.StatusCode, string(body))
@@ -272,8 +473,66 @@ func (vp *VideoProcessor) markVideoComplete(uuid string) error {
 	return nil
 }
 
-func (vp *VideoProcessor) markVideoFailed(uuid string) error {
-	data := structs.VideoFailRequest{Uuid: uuid}
+// reportPlaylistEntries completes an expand job, after which the server adds a
+// video job for every entry
+func (vp *VideoProcessor) reportPlaylistEntries(uuid, token string, entries []string) (*structs.VideoExpandResponse, error) {
+	data := structs.VideoExpandRequest{Uuid: uuid, Token: token, Entries: entries}
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal JSON: %v", err)
+	}
+
+	req, err := http.NewRequest("POST", vp.serverURL+"/video/expand", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+vp.fireCastSecret)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Printf("Warning: failed to close response body: %v", err)
+		}
+	}()
+
+	if resp.StatusCode == http.StatusGone {
+		return nil, errVideoCancelled
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &httpStatusError{
+			statusCode: resp.StatusCode,
+			message:    fmt.Sprintf("server error: %d %s", resp.StatusCode, string(body)),
+		}
+	}
+
+	var expandResp structs.VideoExpandResponse
+	if err := json.NewDecoder(resp.Body).Decode(&expandResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	return &expandResp, nil
+}
+
+func (vp *VideoProcessor) markVideoFailed(uuid, token string, failure error) error {
+	data := structs.VideoFailRequest{
+		Uuid:  uuid,
+		Token: token,
+		Error: failure.Error(),
+		Class: structs.ClassPermanent,
+	}
+	var videoErr *videoError
+	if errors.As(failure, &videoErr) {
+		data.Stage = videoErr.stage
+		data.Class = videoErr.class
+	}
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		return fmt.Errorf("failed to marshal JSON: %v", err)
@@ -298,6 +557,10 @@ func (vp *VideoProcessor) markVideoFailed(uuid string) error {
 		}
 	}()
 
+	if resp.StatusCode == http.StatusGone {
+		return errVideoCancelled
+	}
+
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		return fmt.Errorf("server error: %d %s", resp.StatusCode, string(body))
@@ -306,12 +569,18 @@ func (vp *VideoProcessor) markVideoFailed(uuid string) error {
 	return nil
 }
 
-func (vp *VideoProcessor) processVideo(video *structs.VideoResponse) error {
+// processVideo downloads, uploads and assigns a video, calling progress as each stage starts
+func (vp *VideoProcessor) processVideo(ctx context.Context, video *structs.VideoResponse, progress func(stage string)) error {
 	log.Printf("Processing video: %s (UUID: %s, Playlist: %d)", video.VideoUrl, video.Uuid, video.PlaylistId)
 
-	mp3File, err := vp.downloadVideoAsMP3(video.VideoUrl)
+	progress(structs.StageDownload)
+	mp3File, err := vp.downloadVideoAsMP3(ctx, video.VideoUrl)
 	if err != nil {
-		return fmt.Errorf("failed to download video: %v", err)
+		return &videoError{
+			stage: structs.StageDownload,
+			class: classifyError(err),
+			err:   fmt.Errorf("failed to download video: %v", err),
+		}
 	}
 	defer func() {
 		if err := os.Remove(mp3File); err != nil {
@@ -319,19 +588,66 @@ func (vp *VideoProcessor) processVideo(video *structs.VideoResponse) error {
 		}
 	}()
 
-	songID, err := vp.uploadToAzuraCast(mp3File)
+	progress(structs.StageUpload)
+	songID, err := vp.uploadToAzuraCast(ctx, mp3File)
 	if err != nil {
-		return fmt.Errorf("failed to upload to AzuraCast: %v", err)
+		return &videoError{
+			stage: structs.StageUpload,
+			class: classifyError(err),
+			err:   fmt.Errorf("failed to upload to AzuraCast: %v", err),
+		}
 	}
 
-	if err := vp.assignPlaylistToSong(songID, video.PlaylistId); err != nil {
-		return fmt.Errorf("failed to assign playlist: %v", err)
+	progress(structs.StageAssign)
+	if err := vp.assignPlaylistToSong(ctx, songID, video.PlaylistId); err != nil {
+		return &videoError{
+			stage: structs.StageAssign,
+			class: classifyError(err),
+			err:   fmt.Errorf("failed to assign playlist: %v", err),
+		}
 	}
 
 	log.Printf("Successfully processed video %s -> song ID %d", video.VideoUrl, songID)
 	return nil
 }
 
+// expandPlaylist lists the entries of a playlist and reports them to the server
+func (vp *VideoProcessor) expandPlaylist(ctx context.Context, video *structs.VideoResponse, progress func(stage string)) error {
+	log.Printf("Expanding playlist: %s (UUID: %s, Playlist: %d)", video.VideoUrl, video.Uuid, video.PlaylistId)
+
+	progress(structs.StageDownload)
+	entries, err := vp.listPlaylistEntries(ctx, video.VideoUrl)
+	if err != nil {
+		return &videoError{
+			stage: structs.StageDownload,
+			class: classifyError(err),
+			err:   fmt.Errorf("failed to list playlist entries: %v", err),
+		}
+	}
+
+	if len(entries) > structs.MaxExpandEntries {
+		log.Printf("Playlist %s has %d entries, only adding the first %d", video.VideoUrl, len(entries), structs.MaxExpandEntries)
+		entries = entries[:structs.MaxExpandEntries]
+	}
+
+	expandResp, err := vp.reportPlaylistEntries(video.Uuid, video.Token, entries)
+	if err == errVideoCancelled {
+		return err
+	}
+	if err != nil {
+		// Entries the server rejects as invalid are rejected again on retry
+		return &videoError{
+			stage: structs.StageDownload,
+			class: classifyError(err),
+			err:   fmt.Errorf("failed to report playlist entries: %v", err),
+		}
+	}
+
+	log.Printf("Expanded playlist %s: %d added, %d already added, %d rejected",
+		video.VideoUrl, expandResp.Added, expandResp.Duplicates, expandResp.Rejected)
+	return nil
+}
+
 func (vp *VideoProcessor) run() {
 	log.Println("Starting video processing...")
 
@@ -345,21 +661,61 @@ func (vp *VideoProcessor) run() {
 		}
 
 		if video == nil {
-			log.Println("No videos to process, waiting 10 seconds...")
-			time.Sleep(5 * time.Second)
+			// With long-polling the server already waited for a video
+			if vp.pollWait == 0 {
+				log.Println("No videos to process, waiting 5 seconds...")
+				time.Sleep(5 * time.Second)
+			}
 			continue
 		}
 
 		log.Printf("Found video to process: %s", video.VideoUrl)
-		if err := vp.processVideo(video); err != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		stopHeartbeat := vp.startHeartbeat(video.Uuid, video.Token, cancel)
+		progress := func(stage string) {
+			err := vp.sendHeartbeat(video.Uuid, video.Token, stage)
+			if err == errVideoCancelled {
+				log.Printf("Video %s was cancelled, stopping", video.Uuid)
+				cancel()
+			} else if err != nil {
+				log.Printf("Warning: failed to report progress for video %s: %v", video.Uuid, err)
+			}
+		}
+		if video.Type == structs.JobTypeExpand {
+			err = vp.expandPlaylist(ctx, video, progress)
+		} else {
+			err = vp.processVideo(ctx, video, progress)
+		}
+		stopHeartbeat()
+		cancelled := ctx.Err() != nil || err == errVideoCancelled
+		cancel()
+
+		if cancelled {
+			// Reporting back lets the server drop the video right away instead of
+			// waiting for the lease to expire
+			if markErr := vp.markVideoFailed(video.Uuid, video.Token, errVideoCancelled); markErr != nil && markErr != errVideoCancelled {
+				log.Printf("Error releasing cancelled video: %v", markErr)
+			}
+			log.Printf("Cancelled processing video: %s", video.VideoUrl)
+			continue
+		}
+
+		if err != nil {
 			log.Printf("Error processing video %s: %v", video.VideoUrl, err)
-			if markErr := vp.markVideoFailed(video.Uuid); markErr != nil {
+			if markErr := vp.markVideoFailed(video.Uuid, video.Token, err); markErr != nil {
 				log.Printf("Error marking video as failed: %v", markErr)
 			}
 			continue
 		}
 
-		if err := vp.markVideoComplete(video.Uuid); err != nil {
+		// An expand job was already completed by reporting its entries
+		if video.Type == structs.JobTypeExpand {
+			continue
+		}
+
+		if err := vp.markVideoComplete(video.Uuid, video.Token); err == errVideoCancelled {
+			log.Printf("Video %s was cancelled before it could be marked as complete", video.Uuid)
+		} else if err != nil {
 			log.Printf("Error marking video as complete: %v", err)
 		}
 
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"firecast/pkg/structs"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
 )
@@ -41,6 +45,7 @@ func createAuthenticatedRequest(method, url string, body *bytes.Buffer) (*http.R
 	if method == "POST" {
 		req.Header.Set("Content-Type", "application/json")
 	}
+	req.Header.Set("X-Firecast-Client", structs.ClientCLI)
 
 	if fireCastSecret != "" {
 		req.Header.Set("Authorization", "Bearer "+fireCastSecret)
@@ -71,6 +76,33 @@ func printResponse(resp *http.Response) {
 	fmt.Println("Response Body:", string(body))
 }
 
+// printStreamResponse prints a server-sent event stream line by line until it ends
+func printStreamResponse(resp *http.Response) {
+	if resp == nil {
+		fmt.Println("No response received.")
+		return
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			fmt.Printf("Warning: failed to close response body: %v\n", err)
+		}
+	}()
+
+	fmt.Println("Response Status Code:", resp.StatusCode)
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "data: ") {
+			fmt.Println(strings.TrimPrefix(line, "data: "))
+		} else if resp.StatusCode != http.StatusOK {
+			fmt.Println(line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Println("Error reading event stream:", err)
+	}
+}
+
 func printPlaylistsResponse(resp *http.Response) {
 	if resp == nil {
 		fmt.Println("No response received.")
@@ -94,6 +126,47 @@ func printPlaylistsResponse(resp *http.Response) {
 
 }
 
+func printStatusResponse(resp *http.Response) {
+	if resp == nil {
+		fmt.Println("No response received.")
+		return
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			fmt.Printf("Warning: failed to close response body: %v\n", err)
+		}
+	}()
+
+	fmt.Println("Response Status Code:", resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Println("Error reading response body:", err)
+		return
+	}
+
+	var status structs.StatusResponse
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &status) != nil {
+		fmt.Println("Response Body:", string(body))
+		return
+	}
+
+	fmt.Println("Queue:", status.QueueLength)
+	for _, priority := range structs.Priorities {
+		fmt.Printf("  %s: %d\n", priority, status.QueueByPriority[priority])
+	}
+	fmt.Println("Scheduled:", status.ScheduledCount)
+	fmt.Println("In progress:", status.WipCount)
+	fmt.Println("Done:", status.DoneCount)
+	fmt.Println("Failed:", status.FailCount)
+	fmt.Println("Providers:", strings.Join(status.Providers, ", "))
+	if status.Janitor.LastRunAt != 0 {
+		fmt.Printf("Pruned: %d done, %d failed (last run: %d done, %d failed)\n",
+			status.Janitor.DonePruned, status.Janitor.FailPruned,
+			status.Janitor.LastDonePruned, status.Janitor.LastFailPruned)
+	}
+}
+
 func health() *http.Response {
 	resp, err := http.Get(fireCastUrl + "/healthz")
 	if err != nil {
@@ -105,8 +178,8 @@ func health() *http.Response {
 
 func add() *http.Response {
 	if len(os.Args) < 3 {
-		fmt.Println("Error: YouTube video URL is required")
-		fmt.Println("Usage: go run main.go add <youtube_url>")
+		fmt.Println("Error: video URL is required")
+		fmt.Println("Usage: go run main.go add <url> [high|normal|low] [delay=<seconds>] [force]")
 		return nil
 	}
 
@@ -116,6 +189,21 @@ func add() *http.Response {
 		VideoUrl:   videoUrl,
 		PlaylistId: 6,
 	}
+	for _, arg := range os.Args[3:] {
+		switch {
+		case arg == "force":
+			videoReq.Force = true
+		case strings.HasPrefix(arg, "delay="):
+			delay, err := strconv.Atoi(strings.TrimPrefix(arg, "delay="))
+			if err != nil {
+				fmt.Println("Error: delay must be a number of seconds")
+				return nil
+			}
+			videoReq.Delay = delay
+		default:
+			videoReq.Priority = arg
+		}
+	}
 
 	jsonData, err := json.Marshal(videoReq)
 	if err != nil {
@@ -138,10 +226,52 @@ func add() *http.Response {
 	return resp
 }
 
+func batch() *http.Response {
+	if len(os.Args) < 3 {
+		fmt.Println("Error: at least one video URL is required")
+		fmt.Println("Usage: go run main.go batch <url> [url...]")
+		return nil
+	}
+
+	fmt.Println("Sending batch of", len(os.Args)-2, "video requests...")
+	batchReq := structs.VideoAddBatchRequest{}
+	for _, videoUrl := range os.Args[2:] {
+		batchReq.Items = append(batchReq.Items, structs.VideoAddRequest{
+			VideoUrl:   videoUrl,
+			PlaylistId: 6,
+		})
+	}
+
+	jsonData, err := json.Marshal(batchReq)
+	if err != nil {
+		fmt.Println("Error marshalling JSON:", err)
+		return nil
+	}
+
+	req, err := createAuthenticatedRequest("POST", fireCastUrl+"/video/add/batch", bytes.NewBuffer(jsonData))
+	if err != nil {
+		fmt.Println("Error creating request:", err)
+		return nil
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println("Error making POST request:", err)
+		return nil
+	}
+	return resp
+}
+
 func get() *http.Response {
+	getUrl := fireCastUrl + "/video/get"
+	if len(os.Args) > 2 {
+		getUrl += "?wait=" + url.QueryEscape(os.Args[2])
+	}
+
 	fmt.Println("Retrieving video...")
 
-	req, err := createAuthenticatedRequest("GET", fireCastUrl+"/video/get", nil)
+	req, err := createAuthenticatedRequest("GET", getUrl, nil)
 	if err != nil {
 		fmt.Println("Error creating request:", err)
 		return nil
@@ -156,11 +286,100 @@ func get() *http.Response {
 	return resp
 }
 
+func info() *http.Response {
+	if len(os.Args) < 3 {
+		fmt.Println("Error: video UUID is required")
+		fmt.Println("Usage: go run main.go info <video_uuid>")
+		return nil
+	}
+
+	fmt.Println("Retrieving video:", os.Args[2])
+
+	req, err := createAuthenticatedRequest("GET", fireCastUrl+"/video/"+url.PathEscape(os.Args[2]), nil)
+	if err != nil {
+		fmt.Println("Error creating request:", err)
+		return nil
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println("Error making GET request:", err)
+		return nil
+	}
+	return resp
+}
+
+func videoEvents() *http.Response {
+	if len(os.Args) < 3 {
+		fmt.Println("Error: video UUID is required")
+		fmt.Println("Usage: go run main.go events <video_uuid>")
+		return nil
+	}
+
+	fmt.Println("Retrieving events of video:", os.Args[2])
+
+	req, err := createAuthenticatedRequest("GET", fireCastUrl+"/video/"+url.PathEscape(os.Args[2])+"/events", nil)
+	if err != nil {
+		fmt.Println("Error creating request:", err)
+		return nil
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println("Error making GET request:", err)
+		return nil
+	}
+	return resp
+}
+
+func heartbeat() *http.Response {
+	if len(os.Args) < 4 {
+		fmt.Println("Error: video UUID and attempt token are required")
+		fmt.Println("Usage: go run main.go heartbeat <video_uuid> <token>")
+		return nil
+	}
+
+	var videoUuid structs.VideoHeartbeatRequest
+
+	videoUuid.Uuid = os.Args[2]
+	videoUuid.Token = os.Args[3]
+
+	jsonData, err := json.Marshal(videoUuid)
+	if err != nil {
+		fmt.Println("Error marshalling JSON:", err)
+		return nil
+	}
+
+	fmt.Println("Sending heartbeat for video:", videoUuid)
+
+	req, err := createAuthenticatedRequest("POST", fireCastUrl+"/video/heartbeat", bytes.NewBuffer(jsonData))
+	if err != nil {
+		fmt.Println("Error creating request:", err)
+		return nil
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println("Error making POST request:", err)
+		return nil
+	}
+	return resp
+}
+
 func done() *http.Response {
+	if len(os.Args) < 4 {
+		fmt.Println("Error: video UUID and attempt token are required")
+		fmt.Println("Usage: go run main.go done <video_uuid> <token>")
+		return nil
+	}
 
 	var videoUuid structs.VideoDoneRequest
 
 	videoUuid.Uuid = os.Args[2]
+	videoUuid.Token = os.Args[3]
 
 	jsonData, err := json.Marshal(videoUuid)
 	if err != nil {
@@ -185,11 +404,59 @@ func done() *http.Response {
 	return resp
 }
 
+func expand() *http.Response {
+	if len(os.Args) < 5 {
+		fmt.Println("Error: video UUID, attempt token and at least one video ID are required")
+		fmt.Println("Usage: go run main.go expand <video_uuid> <token> <video_id> [video_id...]")
+		return nil
+	}
+
+	var expandReq structs.VideoExpandRequest
+
+	expandReq.Uuid = os.Args[2]
+	expandReq.Token = os.Args[3]
+	expandReq.Entries = os.Args[4:]
+
+	jsonData, err := json.Marshal(expandReq)
+	if err != nil {
+		fmt.Println("Error marshalling JSON:", err)
+		return nil
+	}
+
+	fmt.Println("Expanding playlist:", expandReq)
+
+	req, err := createAuthenticatedRequest("POST", fireCastUrl+"/video/expand", bytes.NewBuffer(jsonData))
+	if err != nil {
+		fmt.Println("Error creating request:", err)
+		return nil
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println("Error making POST request:", err)
+		return nil
+	}
+	return resp
+}
+
 func fail() *http.Response {
+	if len(os.Args) < 4 {
+		fmt.Println("Error: video UUID and attempt token are required")
+		fmt.Println("Usage: go run main.go fail <video_uuid> <token> [transient|permanent] [error message]")
+		return nil
+	}
 
-	var videoUuid structs.VideoDoneRequest
+	var videoUuid structs.VideoFailRequest
 
 	videoUuid.Uuid = os.Args[2]
+	videoUuid.Token = os.Args[3]
+	if len(os.Args) > 4 {
+		videoUuid.Class = os.Args[4]
+	}
+	if len(os.Args) > 5 {
+		videoUuid.Error = strings.Join(os.Args[5:], " ")
+	}
 
 	jsonData, err := json.Marshal(videoUuid)
 	if err != nil {
@@ -214,6 +481,65 @@ func fail() *http.Response {
 	return resp
 }
 
+func retry() *http.Response {
+	if len(os.Args) < 3 {
+		fmt.Println("Error: video UUID is required")
+		fmt.Println("Usage: go run main.go retry <video_uuid> [reset]")
+		return nil
+	}
+
+	retryReq := structs.VideoRetryRequest{
+		Uuids:        []string{os.Args[2]},
+		ResetRetries: len(os.Args) > 3 && os.Args[3] == "reset",
+	}
+
+	jsonData, err := json.Marshal(retryReq)
+	if err != nil {
+		fmt.Println("Error marshalling JSON:", err)
+		return nil
+	}
+
+	fmt.Println("Retrying video:", os.Args[2])
+
+	req, err := createAuthenticatedRequest("POST", fireCastUrl+"/video/retry", bytes.NewBuffer(jsonData))
+	if err != nil {
+		fmt.Println("Error creating request:", err)
+		return nil
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println("Error making POST request:", err)
+		return nil
+	}
+	return resp
+}
+
+func cancel() *http.Response {
+	if len(os.Args) < 3 {
+		fmt.Println("Error: video UUID is required")
+		fmt.Println("Usage: go run main.go cancel <video_uuid>")
+		return nil
+	}
+
+	fmt.Println("Cancelling video:", os.Args[2])
+
+	req, err := createAuthenticatedRequest("DELETE", fireCastUrl+"/video/"+url.PathEscape(os.Args[2]), nil)
+	if err != nil {
+		fmt.Println("Error creating request:", err)
+		return nil
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println("Error making DELETE request:", err)
+		return nil
+	}
+	return resp
+}
+
 func status() *http.Response {
 	fmt.Println("Retrieving status...")
 
@@ -232,6 +558,181 @@ func status() *http.Response {
 	return resp
 }
 
+func list() *http.Response {
+	if len(os.Args) < 3 {
+		fmt.Println("Error: listing is required")
+		fmt.Println("Usage: go run main.go list <queue|scheduled|wip|done|fail> [cursor]")
+		return nil
+	}
+
+	listUrl := fireCastUrl + "/status/" + url.PathEscape(os.Args[2])
+	if len(os.Args) > 3 {
+		listUrl += "?cursor=" + url.QueryEscape(os.Args[3])
+	}
+
+	fmt.Println("Listing videos:", os.Args[2])
+
+	req, err := createAuthenticatedRequest("GET", listUrl, nil)
+	if err != nil {
+		fmt.Println("Error creating request:", err)
+		return nil
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println("Error making GET request:", err)
+		return nil
+	}
+	return resp
+}
+
+func watch() *http.Response {
+	query := url.Values{}
+	for _, arg := range os.Args[2:] {
+		if playlistId, found := strings.CutPrefix(arg, "playlist="); found {
+			query.Set("playlistId", playlistId)
+		} else {
+			query.Set("uuid", arg)
+		}
+	}
+
+	fmt.Println("Watching video events, press Ctrl+C to stop")
+
+	req, err := createAuthenticatedRequest("GET", fireCastUrl+"/events?"+query.Encode(), nil)
+	if err != nil {
+		fmt.Println("Error creating request:", err)
+		return nil
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println("Error making GET request:", err)
+		return nil
+	}
+	return resp
+}
+
+func webhook() *http.Response {
+	usage := "Usage: go run main.go webhook <add <url> [event,...]|list|delete <id>|deliveries <id>>"
+	if len(os.Args) < 3 {
+		fmt.Println("Error: webhook command is required")
+		fmt.Println(usage)
+		return nil
+	}
+
+	var req *http.Request
+	var err error
+	switch {
+	case os.Args[2] == "add" && len(os.Args) > 3:
+		webhookReq := structs.WebhookRequest{Url: os.Args[3]}
+		if len(os.Args) > 4 {
+			webhookReq.Events = strings.Split(os.Args[4], ",")
+		}
+		jsonData, marshalErr := json.Marshal(webhookReq)
+		if marshalErr != nil {
+			fmt.Println("Error marshalling JSON:", marshalErr)
+			return nil
+		}
+		req, err = createAuthenticatedRequest("POST", fireCastUrl+"/webhooks", bytes.NewBuffer(jsonData))
+	case os.Args[2] == "list":
+		req, err = createAuthenticatedRequest("GET", fireCastUrl+"/webhooks", nil)
+	case os.Args[2] == "delete" && len(os.Args) > 3:
+		req, err = createAuthenticatedRequest("DELETE", fireCastUrl+"/webhooks/"+url.PathEscape(os.Args[3]), nil)
+	case os.Args[2] == "deliveries" && len(os.Args) > 3:
+		req, err = createAuthenticatedRequest("GET", fireCastUrl+"/webhooks/"+url.PathEscape(os.Args[3])+"/deliveries", nil)
+	default:
+		fmt.Println(usage)
+		return nil
+	}
+	if err != nil {
+		fmt.Println("Error creating request:", err)
+		return nil
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println("Error making request:", err)
+		return nil
+	}
+	return resp
+}
+
+func token() *http.Response {
+	usage := "Usage: go run main.go token <add <name> <scope,...> [expires_in_seconds]|list|revoke <id>>"
+	if len(os.Args) < 3 {
+		fmt.Println("Error: token command is required")
+		fmt.Println(usage)
+		return nil
+	}
+
+	var req *http.Request
+	var err error
+	switch {
+	case os.Args[2] == "add" && len(os.Args) > 4:
+		tokenReq := structs.TokenRequest{Name: os.Args[3], Scopes: strings.Split(os.Args[4], ",")}
+		if len(os.Args) > 5 {
+			expiresIn, parseErr := strconv.ParseInt(os.Args[5], 10, 64)
+			if parseErr != nil {
+				fmt.Println("Error: expires_in_seconds must be a number")
+				return nil
+			}
+			tokenReq.ExpiresIn = expiresIn
+		}
+		jsonData, marshalErr := json.Marshal(tokenReq)
+		if marshalErr != nil {
+			fmt.Println("Error marshalling JSON:", marshalErr)
+			return nil
+		}
+		req, err = createAuthenticatedRequest("POST", fireCastUrl+"/tokens", bytes.NewBuffer(jsonData))
+	case os.Args[2] == "list":
+		req, err = createAuthenticatedRequest("GET", fireCastUrl+"/tokens", nil)
+	case os.Args[2] == "revoke" && len(os.Args) > 3:
+		req, err = createAuthenticatedRequest("DELETE", fireCastUrl+"/tokens/"+url.PathEscape(os.Args[3]), nil)
+	default:
+		fmt.Println(usage)
+		return nil
+	}
+	if err != nil {
+		fmt.Println("Error creating request:", err)
+		return nil
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println("Error making request:", err)
+		return nil
+	}
+	return resp
+}
+
+func audit() *http.Response {
+	query := url.Values{}
+	if len(os.Args) > 2 && os.Args[2] != "" {
+		query.Set("action", os.Args[2])
+	}
+	if len(os.Args) > 3 {
+		query.Set("cursor", os.Args[3])
+	}
+
+	req, err := createAuthenticatedRequest("GET", fireCastUrl+"/audit?"+query.Encode(), nil)
+	if err != nil {
+		fmt.Println("Error creating request:", err)
+		return nil
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println("Error making GET request:", err)
+		return nil
+	}
+	return resp
+}
+
 func playlists() *http.Response {
 	fmt.Println("Retrieving playlists...")
 
@@ -254,11 +755,26 @@ func help() {
 	fmt.Println("Usage: go run main.go <command>")
 	fmt.Println("Commands:")
 	fmt.Println("  health - Check the health of the service")
-	fmt.Println("  add <youtube_url> - Add a video")
-	fmt.Println("  get - Get a video")
-	fmt.Println("  done <video_uuid> - Mark a video as done")
-	fmt.Println("  fail <video_uuid> - Mark a video as failed")
+	fmt.Println("  add <url> [high|normal|low] [delay=<seconds>] [force] - Add a video, force skips duplicate detection")
+	fmt.Println("      A playlist URL adds an expand job that a worker turns into one video per entry")
+	fmt.Println("  batch <url> [url...] - Add several videos at once")
+	fmt.Println("  get [wait] - Get a video, waiting up to e.g. 30s for one to be queued")
+	fmt.Println("  info <video_uuid> - Show the state and metadata of a video")
+	fmt.Println("  events <video_uuid> - Show the state transitions of a video")
+	fmt.Println("  heartbeat <video_uuid> <token> - Extend the lease on a video")
+	fmt.Println("  done <video_uuid> <token> - Mark a video as done")
+	fmt.Println("  expand <video_uuid> <token> <video_id> [video_id...] - Complete an expand job with its playlist entries")
+	fmt.Println("  fail <video_uuid> <token> [transient|permanent] [error message] - Mark a video as failed")
+	fmt.Println("  retry <video_uuid> [reset] - Move a failed video back into the queue")
+	fmt.Println("  cancel <video_uuid> - Cancel a video, stopping its worker if it is in progress")
+	fmt.Println("  watch [video_uuid] [playlist=<id>] - Stream video events as they happen")
+	fmt.Println("  webhook add <url> [event,...] - Subscribe a URL to video events, done and failed by default")
+	fmt.Println("  webhook list|delete <id>|deliveries <id> - Manage webhooks and show their deliveries")
+	fmt.Println("  token add <name> <submit|worker|read|admin,...> [expires_in_seconds] - Create a named API token")
+	fmt.Println("  token list|revoke <id> - Manage API tokens")
+	fmt.Println("  audit [action] [cursor] - Show administrative actions, newest first")
 	fmt.Println("  status - Get the status of the service")
+	fmt.Println("  list <queue|scheduled|wip|done|fail> [cursor] - List videos in a state")
 	fmt.Println("  playlists - Get all playlists")
 }
 
@@ -283,14 +799,38 @@ func main() {
 		resp = health()
 	case "add":
 		resp = add()
+	case "batch":
+		resp = batch()
 	case "get":
 		resp = get()
+	case "info":
+		resp = info()
+	case "events":
+		resp = videoEvents()
+	case "heartbeat":
+		resp = heartbeat()
 	case "done":
 		resp = done()
+	case "expand":
+		resp = expand()
 	case "fail":
 		resp = fail()
+	case "retry":
+		resp = retry()
+	case "cancel":
+		resp = cancel()
+	case "watch":
+		resp = watch()
+	case "webhook":
+		resp = webhook()
+	case "token":
+		resp = token()
+	case "audit":
+		resp = audit()
 	case "status":
 		resp = status()
+	case "list":
+		resp = list()
 	case "playlists":
 		resp = playlists()
 	default:
@@ -298,9 +838,14 @@ func main() {
 		return
 	}
 
-	if command == "playlists" {
+	switch command {
+	case "playlists":
 		printPlaylistsResponse(resp)
-	} else {
+	case "status":
+		printStatusResponse(resp)
+	case "watch":
+		printStreamResponse(resp)
+	default:
 		printResponse(resp)
 	}
 }
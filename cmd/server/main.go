@@ -6,8 +6,20 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
+	"firecast/pkg/backoff"
+	"firecast/pkg/events"
 	"firecast/pkg/handler"
+	"firecast/pkg/janitor"
+	"firecast/pkg/migrations"
+	"firecast/pkg/provider"
+	"firecast/pkg/ratelimit"
+	"firecast/pkg/scheduler"
+	"firecast/pkg/store"
+	"firecast/pkg/structs"
+	"firecast/pkg/webhooks"
 	"firecast/pkg/wiprecovery"
 
 	"github.com/go-chi/chi/v5"
@@ -38,6 +50,27 @@ func main() {
 		return
 	}
 
+	// WIP_TIMEOUT is the lease a worker gets on a claimed video, renewed by heartbeats
+	wipTimeoutStr := os.Getenv("WIP_TIMEOUT")
+	if wipTimeoutStr == "" {
+		wipTimeoutStr = "300"
+	}
+	wipTimeout, err := strconv.Atoi(wipTimeoutStr)
+	if err != nil {
+		log.Printf("Invalid WIP_TIMEOUT value: %s, using default 300", wipTimeoutStr)
+		wipTimeout = 300
+	}
+
+	wipRetryStr := os.Getenv("WIP_RETRY")
+	if wipRetryStr == "" {
+		wipRetryStr = "3"
+	}
+	maxRetries, err := strconv.Atoi(wipRetryStr)
+	if err != nil {
+		log.Printf("Invalid WIP_RETRY value: %s, using default 3", wipRetryStr)
+		maxRetries = 3
+	}
+
 	rdb = redis.NewClient(&redis.Options{
 		Addr: fmt.Sprintf("%s:%s", redisHost, redisPort),
 		DB:   0,
@@ -47,7 +80,40 @@ func main() {
 		log.Fatalf("Redis connection failed: %v", err)
 	}
 
-	h := handler.NewHandler(rdb, fireCastSecret, azuraCastApiKey, azuraCastDomain)
+	if err := migrations.Run(ctx, rdb); err != nil {
+		log.Fatalf("Redis migration failed: %v", err)
+	}
+
+	storeConfig := store.Config{
+		LeaseDuration: time.Duration(wipTimeout) * time.Second,
+		MaxRetries:    maxRetries,
+		RetryPolicy:   backoff.PolicyFromEnv(),
+	}
+
+	// JOB_STORE picks where jobs, their metadata and event logs are kept. Live
+	// events, webhooks, tokens and rate limits stay in Redis either way. The
+	// memory store loses its jobs on restart and only suits a single server.
+	var jobStore store.Store
+	switch jobStoreName := os.Getenv("JOB_STORE"); jobStoreName {
+	case "", "redis":
+		jobStore = store.NewRedis(rdb, storeConfig)
+	case "sqlite":
+		sqlitePath := os.Getenv("SQLITE_PATH")
+		if sqlitePath == "" {
+			sqlitePath = "firecast.db"
+		}
+		sqliteStore, err := store.OpenSQLite(ctx, sqlitePath, storeConfig, events.RedisPublisher(rdb))
+		if err != nil {
+			log.Fatalf("SQLite job store failed: %v", err)
+		}
+		jobStore = sqliteStore
+	case "memory":
+		jobStore = store.NewMemory(storeConfig, events.RedisPublisher(rdb))
+	default:
+		log.Fatalf("Invalid JOB_STORE value: %s, must be redis, sqlite or memory", jobStoreName)
+	}
+
+	h := handler.NewHandler(rdb, jobStore, fireCastSecret, azuraCastApiKey, azuraCastDomain, provider.FromEnv(), ratelimit.New(rdb, ratelimit.LimitsFromEnv()))
 
 	r := chi.NewRouter()
 
@@ -59,20 +125,49 @@ func main() {
 	r.Get("/health", h.HealthzHandler)
 	r.Get("/healthz", h.HealthzHandler)
 
+	// Every route declares the scope a token needs to call it. FIRECAST_SECRET
+	// has them all, so the extension, CLI and worker can also be given named
+	// tokens with just the scope they need.
+	submit := h.RequireScope(structs.ScopeSubmit)
+	worker := h.RequireScope(structs.ScopeWorker)
+	read := h.RequireScope(structs.ScopeRead)
+	admin := h.RequireScope(structs.ScopeAdmin)
+
 	r.Group(func(r chi.Router) {
 		r.Use(h.AuthMiddleware)
-		r.Get("/playlists", h.PlaylistsHandler)
-		r.Post("/video/add", h.VideoAddHandler)
-		r.Get("/video/get", h.VideoGetHandler)
-		r.Post("/video/done", h.VideoDoneHandler)
-		r.Post("/video/fail", h.VideoFailHandler)
-		r.Get("/status", h.StatusHandler)
-		// r.Get("/status/fail")
-		// r.Get("/status/wip")
-		// r.Get("/status/done")
+		r.With(h.RequireScope(structs.ScopeSubmit, structs.ScopeRead)).Get("/playlists", h.PlaylistsHandler)
+		r.With(submit).Post("/video/add", h.VideoAddHandler)
+		r.With(submit).Post("/video/add/batch", h.VideoAddBatchHandler)
+		r.With(worker).Get("/video/get", h.VideoGetHandler)
+		r.With(read).Get("/video/{uuid}", h.VideoDetailHandler)
+		r.With(submit).Delete("/video/{uuid}", h.VideoCancelHandler)
+		r.With(read).Get("/video/{uuid}/events", h.VideoEventsHandler)
+		r.With(worker).Post("/video/heartbeat", h.VideoHeartbeatHandler)
+		r.With(worker).Post("/video/done", h.VideoDoneHandler)
+		r.With(worker).Post("/video/fail", h.VideoFailHandler)
+		r.With(worker).Post("/video/expand", h.VideoExpandHandler)
+		r.With(admin).Post("/video/retry", h.VideoRetryHandler)
+		r.With(read).Get("/events", h.EventsHandler)
+		r.With(admin).Post("/webhooks", h.WebhookCreateHandler)
+		r.With(admin).Get("/webhooks", h.WebhookListHandler)
+		r.With(admin).Delete("/webhooks/{id}", h.WebhookDeleteHandler)
+		r.With(admin).Get("/webhooks/{id}/deliveries", h.WebhookDeliveriesHandler)
+		r.With(admin).Post("/tokens", h.TokenCreateHandler)
+		r.With(admin).Get("/tokens", h.TokenListHandler)
+		r.With(admin).Delete("/tokens/{id}", h.TokenRevokeHandler)
+		r.With(admin).Get("/audit", h.AuditListHandler)
+		r.With(read).Get("/status", h.StatusHandler)
+		r.With(read).Get("/status/queue", h.StatusQueueHandler)
+		r.With(read).Get("/status/scheduled", h.StatusScheduledHandler)
+		r.With(read).Get("/status/wip", h.StatusWipHandler)
+		r.With(read).Get("/status/done", h.StatusDoneHandler)
+		r.With(read).Get("/status/fail", h.StatusFailHandler)
 	})
 
-	wiprecovery.WipRecovery(ctx, rdb)
+	wiprecovery.WipRecovery(ctx, jobStore)
+	scheduler.Scheduler(ctx, jobStore)
+	janitor.Janitor(ctx, jobStore)
+	webhooks.Dispatcher(ctx, rdb, jobStore)
 
 	fmt.Println("Server starting on :8080")
 	if err := http.ListenAndServe(":8080", r); err != nil {
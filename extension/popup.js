@@ -163,6 +163,7 @@ async function addVideoToPlaylist(videoUrl, playlistId, settings) {
 
   const headers = {
     "Content-Type": "application/json",
+    "X-Firecast-Client": "extension",
   };
 
   if (settings.firecastSecret) {
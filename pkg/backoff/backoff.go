@@ -0,0 +1,74 @@
+package backoff
+
+import (
+	"log"
+	"math"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Policy decides how long a retried video waits before it can be claimed again.
+// The delay grows from Base by Multiplier per attempt, is spread by up to
+// Jitter (a fraction of the delay) in either direction and never exceeds Max.
+type Policy struct {
+	Base       time.Duration
+	Multiplier float64
+	Max        time.Duration
+	Jitter     float64
+}
+
+// PolicyFromEnv reads the policy from RETRY_BACKOFF_BASE and RETRY_BACKOFF_MAX
+// (seconds), RETRY_BACKOFF_MULTIPLIER and RETRY_BACKOFF_JITTER.
+func PolicyFromEnv() Policy {
+	return Policy{
+		Base:       time.Duration(envFloat("RETRY_BACKOFF_BASE", 30)) * time.Second,
+		Multiplier: envFloat("RETRY_BACKOFF_MULTIPLIER", 2),
+		Max:        time.Duration(envFloat("RETRY_BACKOFF_MAX", 3600)) * time.Second,
+		Jitter:     envFloat("RETRY_BACKOFF_JITTER", 0.2),
+	}
+}
+
+// Delay returns the wait before the next attempt after the given number of
+// attempts have already been made. The first retry waits roughly Base.
+func (p Policy) Delay(attempts int) time.Duration {
+	if p.Base <= 0 {
+		return 0
+	}
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	delay := float64(p.Base) * math.Pow(math.Max(p.Multiplier, 1), float64(attempts-1))
+	if p.Max > 0 && delay > float64(p.Max) {
+		delay = float64(p.Max)
+	}
+	if p.Jitter > 0 {
+		delay *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+	// Jitter must not push a capped delay past Max
+	if p.Max > 0 && delay > float64(p.Max) {
+		delay = float64(p.Max)
+	}
+	return time.Duration(delay)
+}
+
+// NextAttemptAt returns when a video that has made the given number of
+// attempts becomes eligible again
+func (p Policy) NextAttemptAt(now time.Time, attempts int) time.Time {
+	return now.Add(p.Delay(attempts))
+}
+
+func envFloat(name string, fallback float64) float64 {
+	valueStr := os.Getenv(name)
+	if valueStr == "" {
+		return fallback
+	}
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil || value < 0 {
+		log.Printf("Invalid %s value: %s, using default %v", name, valueStr, fallback)
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,105 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"firecast/pkg/structs"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Channel is the pub/sub channel every event is published on, with the uuid
+// and playlist id of its video added, for live subscribers such as GET /events
+const Channel = "videos:events"
+
+// NotifyKey is a list that holds a single token while there may be queued
+// videos. Workers long-polling /video/get block on it instead of polling.
+const NotifyKey = "videos:notify"
+
+// Lua is a script fragment prepended to every script that changes the state of
+// a video, so the transition and its event are written atomically. It defines:
+//   - notifyWorkers(), which wakes a worker waiting on NotifyKey
+//   - publishEvent(uuid, event), which publishes an event table on Channel and,
+//     while any webhook is registered, queues it in webhooks:outbox for the
+//     webhook dispatcher. Events that leave a video queued also notify workers,
+//     and events of a video added by an expand job update the progress
+//     counters of that job.
+//   - appendEvent(uuid, event), which also appends it to the video's event log
+//
+// The table keys follow the JSON names of structs.VideoEvent.
+const Lua = `
+local function notifyWorkers()
+	redis.call('LPUSH', '` + NotifyKey + `', 1)
+	redis.call('LTRIM', '` + NotifyKey + `', 0, 0)
+end
+
+local function updateParent(uuid, event)
+	local parent = redis.call('HGET', 'videos:meta:' .. uuid, 'parent')
+	if not parent or redis.call('EXISTS', 'videos:meta:' .. parent) == 0 then
+		return
+	end
+	if event.type == 'retried' then
+		redis.call('HINCRBY', 'videos:meta:' .. parent, 'children_failed', -1)
+	elseif event.type == 'cancelled' then
+		redis.call('HINCRBY', 'videos:meta:' .. parent, 'children_cancelled', 1)
+	elseif event.state == 'done' then
+		redis.call('HINCRBY', 'videos:meta:' .. parent, 'children_done', 1)
+	elseif event.state == 'fail' then
+		redis.call('HINCRBY', 'videos:meta:' .. parent, 'children_failed', 1)
+	end
+end
+
+local function publishEvent(uuid, event)
+	updateParent(uuid, event)
+	local playlistId = redis.call('HGET', 'videos:meta:' .. uuid, 'playlist_id')
+	event.uuid = uuid
+	event.playlistId = playlistId and tonumber(playlistId) or nil
+	local payload = cjson.encode(event)
+	redis.call('PUBLISH', '` + Channel + `', payload)
+	if redis.call('SCARD', 'webhooks') > 0 then
+		redis.call('RPUSH', 'webhooks:outbox', payload)
+	end
+	if event.state == 'queued' then
+		notifyWorkers()
+	end
+	event.uuid = nil
+	event.playlistId = nil
+end
+
+local function appendEvent(uuid, event)
+	redis.call('RPUSH', 'videos:events:' .. uuid, cjson.encode(event))
+	publishEvent(uuid, event)
+end
+`
+
+// Key returns the Redis list holding the event log of a video
+func Key(uuid string) string {
+	return fmt.Sprintf("videos:events:%s", uuid)
+}
+
+// Publisher hands an event, with the uuid and playlist id of its video set, to
+// live subscribers and the webhook dispatcher. Stores that do not keep their
+// jobs in Redis publish through one once a transition is committed.
+type Publisher func(ctx context.Context, event structs.VideoEvent) error
+
+var publishScript = redis.NewScript(`
+redis.call('PUBLISH', '` + Channel + `', ARGV[1])
+if redis.call('SCARD', 'webhooks') > 0 then
+	redis.call('RPUSH', 'webhooks:outbox', ARGV[1])
+end
+return 1
+`)
+
+// RedisPublisher returns a Publisher that publishes on Channel and queues in
+// webhooks:outbox like publishEvent does
+func RedisPublisher(rdb *redis.Client) Publisher {
+	return func(ctx context.Context, event structs.VideoEvent) error {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return publishScript.Run(ctx, rdb, nil, string(payload)).Err()
+	}
+}
@@ -0,0 +1,163 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"firecast/pkg/structs"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// auditKey is the append-only list of structs.AuditEntry JSON, oldest first.
+// Entries are never trimmed, so the index of an entry is its id.
+const auditKey = "audit"
+
+// clientIP returns the address of the client, which RealIP has already taken
+// from X-Forwarded-For or X-Real-IP when the server is behind a proxy
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// identityFromRequest returns who made an authenticated request and from where
+func identityFromRequest(r *http.Request) structs.Identity {
+	identity := structs.Identity{
+		Client:    structs.ClientAPI,
+		RequestId: middleware.GetReqID(r.Context()),
+		SourceIp:  clientIP(r),
+	}
+	if token := TokenFromContext(r.Context()); token != nil {
+		identity.Name = token.Name
+		identity.TokenId = token.Id
+	}
+	if client := r.Header.Get("X-Firecast-Client"); client == structs.ClientExtension || client == structs.ClientCLI {
+		identity.Client = client
+	}
+	return identity
+}
+
+// identityMeta returns the metadata fields recording the submitter of a video,
+// none if it is unknown
+func identityMeta(identity structs.Identity) []interface{} {
+	if identity.Name == "" {
+		return nil
+	}
+	return []interface{}{
+		"submitted_by", identity.Name,
+		"submitter_token", identity.TokenId,
+		"client", identity.Client,
+		"request_id", identity.RequestId,
+		"source_ip", identity.SourceIp,
+	}
+}
+
+// identityFromMeta returns the submitter of a video, or nil for videos added
+// before submitters were recorded
+func identityFromMeta(meta map[string]string) *structs.Identity {
+	if _, ok := meta["submitted_by"]; !ok {
+		return nil
+	}
+	return &structs.Identity{
+		Name:      meta["submitted_by"],
+		TokenId:   meta["submitter_token"],
+		Client:    meta["client"],
+		RequestId: meta["request_id"],
+		SourceIp:  meta["source_ip"],
+	}
+}
+
+// audit appends an administrative action to the audit log. The action already
+// happened, so a failure to record it is only logged.
+func (h *Handler) audit(r *http.Request, action, target string, details map[string]string) {
+	entryJSON, err := json.Marshal(structs.AuditEntry{
+		At:      time.Now().Unix(),
+		Action:  action,
+		Actor:   identityFromRequest(r),
+		Target:  target,
+		Details: details,
+	})
+	if err == nil {
+		err = h.rdb.RPush(r.Context(), auditKey, entryJSON).Err()
+	}
+	if err != nil {
+		log.Printf("Failed to record %s of %s in the audit log: %v", action, target, err)
+	}
+}
+
+// AuditListHandler pages through the audit log, newest first. ?action= only
+// returns entries of that action.
+func (h *Handler) AuditListHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json")
+
+	filter, err := parseListFilter(r)
+	if err != nil {
+		h.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	action := r.URL.Query().Get("action")
+
+	length, err := h.rdb.LLen(ctx, auditKey).Result()
+	if err != nil {
+		log.Printf("Failed to read audit log: %v", err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to read audit log")
+		return
+	}
+
+	// The cursor is the id of the newest entry not yet returned
+	end := length - 1
+	if filter.Cursor != "" {
+		cursor, err := strconv.ParseInt(filter.Cursor, 10, 64)
+		if err != nil || cursor < 0 || cursor >= length {
+			h.writeErrorResponse(w, http.StatusBadRequest, "Invalid cursor")
+			return
+		}
+		end = cursor
+	}
+
+	response := structs.AuditListResponse{Entries: []structs.AuditEntry{}}
+	for end >= 0 {
+		start := max(0, end-int64(filter.Limit)+1)
+		batch, err := h.rdb.LRange(ctx, auditKey, start, end).Result()
+		if err != nil {
+			log.Printf("Failed to read audit log: %v", err)
+			h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to read audit log")
+			return
+		}
+		slices.Reverse(batch)
+
+		for i, entryJSON := range batch {
+			id := end - int64(i)
+			var entry structs.AuditEntry
+			if err := json.Unmarshal([]byte(entryJSON), &entry); err != nil {
+				log.Printf("Skipping invalid audit entry %d: %v", id, err)
+				continue
+			}
+			if action != "" && entry.Action != action {
+				continue
+			}
+			entry.Id = id
+			response.Entries = append(response.Entries, entry)
+
+			if len(response.Entries) == filter.Limit {
+				if id > 0 {
+					response.NextCursor = fmt.Sprint(id - 1)
+				}
+				h.writeSuccessResponse(w, response)
+				return
+			}
+		}
+		end = start - 1
+	}
+
+	h.writeSuccessResponse(w, response)
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"firecast/pkg/store"
+	"firecast/pkg/structs"
+)
+
+// maxBatchSize caps the number of items in one POST /video/add/batch
+const maxBatchSize = 500
+
+// VideoAddBatchHandler adds many videos at once. Invalid items are rejected
+// individually, and all valid items are stored in one transaction.
+func (h *Handler) VideoAddBatchHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json")
+
+	var batchReq structs.VideoAddBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&batchReq); err != nil {
+		h.writeErrorResponse(w, http.StatusBadRequest, "Invalid JSON format")
+		return
+	}
+
+	if len(batchReq.Items) == 0 {
+		h.writeErrorResponse(w, http.StatusBadRequest, "Items are required")
+		return
+	}
+	if len(batchReq.Items) > maxBatchSize {
+		h.writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("At most %d items can be added at once", maxBatchSize))
+		return
+	}
+
+	response := structs.VideoAddBatchResponse{
+		Status:  true,
+		Results: make([]structs.VideoAddResult, len(batchReq.Items)),
+	}
+	adds := make([]*videoAdd, 0, len(batchReq.Items))
+	accepted := make([]int, 0, len(batchReq.Items))
+	now := time.Now()
+	submitter := identityFromRequest(r)
+	for i, videoReq := range batchReq.Items {
+		response.Results[i].Index = i
+		add, reason := h.prepareVideoAdd(videoReq, submitter, now.Unix())
+		if add == nil {
+			response.Results[i].Error = reason
+			response.Rejected++
+			continue
+		}
+		adds = append(adds, add)
+		accepted = append(accepted, i)
+	}
+
+	// Rejected items do not count against the quotas
+	if !h.allowSubmission(w, r, len(adds), now) {
+		return
+	}
+
+	// Duplicates within the batch resolve to the first occurrence just like
+	// separate adds would
+	jobs := make([]*store.Job, len(adds))
+	for n, add := range adds {
+		jobs[n] = add.job
+	}
+	results, err := h.store.Enqueue(ctx, jobs, now)
+	if err != nil {
+		h.refundSubmission(r, len(adds), now)
+		log.Printf("Failed to store video batch: %v", err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to store video requests")
+		return
+	}
+
+	// Only the videos that were added count against the quotas
+	duplicates := 0
+	for _, result := range results {
+		if result.Duplicate {
+			duplicates++
+		}
+	}
+	h.refundSubmission(r, duplicates, now)
+
+	for n, result := range results {
+		i := accepted[n]
+		response.Results[i].Uuid = result.Uuid
+		if !result.Duplicate {
+			response.Results[i].State = adds[n].state
+			response.Added++
+			continue
+		}
+
+		state, err := h.store.State(ctx, result.Uuid)
+		if err != nil {
+			log.Printf("Failed to get state of video %s: %v", result.Uuid, err)
+			h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to get video state")
+			return
+		}
+		response.Results[i].State = state
+		response.Results[i].Duplicate = true
+		response.Duplicates++
+	}
+
+	h.writeSuccessResponse(w, response)
+}
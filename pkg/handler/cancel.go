@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"firecast/pkg/structs"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// VideoCancelHandler deletes a queued or scheduled video. An in-progress video
+// is only flagged, and is dropped once its worker reports back or its lease expires.
+// Admins can cancel any video, submit tokens only the videos they added.
+func (h *Handler) VideoCancelHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json")
+
+	videoUuid := chi.URLParam(r, "uuid")
+	if videoUuid == "" {
+		h.writeErrorResponse(w, http.StatusBadRequest, "UUID is required")
+		return
+	}
+
+	if !hasScope(r, structs.ScopeAdmin) {
+		video, err := h.store.Lookup(ctx, videoUuid)
+		if err != nil {
+			log.Printf("Failed to look up video %s: %v", videoUuid, err)
+			h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to look up video")
+			return
+		}
+		if video == nil {
+			h.writeErrorResponse(w, http.StatusNotFound, "Video not found")
+			return
+		}
+		token := TokenFromContext(ctx)
+		if token == nil || token.Id == "" || video.Meta["submitter_token"] != token.Id {
+			h.writeErrorResponse(w, http.StatusForbidden, "Only admins can cancel videos added by someone else")
+			return
+		}
+	}
+
+	status, err := h.store.Cancel(ctx, videoUuid, time.Now())
+	if err != nil {
+		log.Printf("Failed to cancel video %s: %v", videoUuid, err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to cancel video")
+		return
+	}
+
+	switch status {
+	case "missing":
+		h.writeErrorResponse(w, http.StatusNotFound, "Video not found")
+	case "finished":
+		h.writeErrorResponse(w, http.StatusConflict, "Video already finished")
+	case "cancelling":
+		h.audit(r, structs.AuditVideoCancel, videoUuid, map[string]string{"state": structs.StateWip})
+		h.writeJSONResponse(w, http.StatusAccepted, map[string]interface{}{
+			"status":  true,
+			"message": "Video is in progress and will be cancelled",
+			"uuid":    videoUuid,
+			"state":   structs.StateWip,
+		})
+	default:
+		h.audit(r, structs.AuditVideoCancel, videoUuid, nil)
+		h.writeSuccessResponse(w, map[string]interface{}{
+			"status":  true,
+			"message": "Video cancelled",
+			"uuid":    videoUuid,
+		})
+	}
+}
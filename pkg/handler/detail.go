@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"firecast/pkg/store"
+	"firecast/pkg/structs"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// detailFromMeta builds the public view of a video from its metadata hash. The
+// submitter is only shown to admins.
+func detailFromMeta(videoUuid, state string, meta map[string]string, admin bool) *structs.VideoDetailResponse {
+	detail := &structs.VideoDetailResponse{
+		Uuid:  videoUuid,
+		State: state,
+		Meta:  meta,
+	}
+	delete(detail.Meta, "attempt_token")
+	detail.Retries, _ = strconv.Atoi(detail.Meta["retries"])
+	detail.NotBefore, _ = strconv.ParseInt(detail.Meta["not_before"], 10, 64)
+	if total, ok := detail.Meta["children_total"]; ok {
+		progress := &structs.ExpandProgress{}
+		progress.Total, _ = strconv.Atoi(total)
+		progress.Duplicates, _ = strconv.Atoi(detail.Meta["children_duplicate"])
+		progress.Done, _ = strconv.Atoi(detail.Meta["children_done"])
+		progress.Failed, _ = strconv.Atoi(detail.Meta["children_failed"])
+		progress.Cancelled, _ = strconv.Atoi(detail.Meta["children_cancelled"])
+		progress.Pending = progress.Total - progress.Done - progress.Failed - progress.Cancelled
+		detail.Progress = progress
+	}
+	if admin {
+		detail.Submitter = identityFromMeta(detail.Meta)
+	} else {
+		for _, field := range structs.IdentityFields {
+			delete(detail.Meta, field)
+		}
+	}
+	if message, ok := detail.Meta["last_error"]; ok {
+		at, _ := strconv.ParseInt(detail.Meta["last_error_at"], 10, 64)
+		detail.LastError = &structs.VideoError{
+			Message: message,
+			Stage:   detail.Meta["last_error_stage"],
+			Class:   detail.Meta["last_error_class"],
+			At:      at,
+		}
+	}
+	return detail
+}
+
+// detailFromVideo builds the public view of a video the store looked up or listed
+func detailFromVideo(video *store.Video, admin bool) *structs.VideoDetailResponse {
+	detail := detailFromMeta(video.Uuid, video.State, video.Meta, admin)
+	detail.QueuePosition = video.QueuePosition
+	detail.LeaseExpiresAt = video.LeaseExpiresAt
+	if video.NotBefore != 0 {
+		detail.NotBefore = video.NotBefore
+	}
+	return detail
+}
+
+// VideoDetailHandler returns everything known about a single video
+func (h *Handler) VideoDetailHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json")
+
+	videoUuid := chi.URLParam(r, "uuid")
+	if videoUuid == "" {
+		h.writeErrorResponse(w, http.StatusBadRequest, "UUID is required")
+		return
+	}
+
+	video, err := h.store.Lookup(ctx, videoUuid)
+	if err != nil {
+		log.Printf("Failed to look up video %s: %v", videoUuid, err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to look up video")
+		return
+	}
+	if video == nil {
+		h.writeErrorResponse(w, http.StatusNotFound, "Video not found")
+		return
+	}
+
+	h.writeSuccessResponse(w, detailFromVideo(video, hasScope(r, structs.ScopeAdmin)))
+}
@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"log"
+	"net/http"
+
+	"firecast/pkg/structs"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// VideoEventsHandler returns the state transitions of a video, oldest first
+func (h *Handler) VideoEventsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json")
+
+	videoUuid := chi.URLParam(r, "uuid")
+	if videoUuid == "" {
+		h.writeErrorResponse(w, http.StatusBadRequest, "UUID is required")
+		return
+	}
+
+	videoEvents, err := h.store.Events(ctx, videoUuid)
+	if err != nil {
+		log.Printf("Failed to get events for video %s: %v", videoUuid, err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to get video events")
+		return
+	}
+	if videoEvents == nil {
+		h.writeErrorResponse(w, http.StatusNotFound, "Video not found")
+		return
+	}
+
+	h.writeSuccessResponse(w, structs.VideoEventsResponse{
+		Uuid:   videoUuid,
+		Events: videoEvents,
+	})
+}
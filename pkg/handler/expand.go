@@ -0,0 +1,170 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"firecast/pkg/ratelimit"
+	"firecast/pkg/store"
+	"firecast/pkg/structs"
+	"firecast/pkg/tokens"
+)
+
+// VideoExpandHandler completes an expand job. Every playlist entry reported by
+// the worker is added as a video job to the same AzuraCast playlist, unless it
+// was already added there.
+func (h *Handler) VideoExpandHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json")
+
+	var expandReq structs.VideoExpandRequest
+	if err := json.NewDecoder(r.Body).Decode(&expandReq); err != nil {
+		h.writeErrorResponse(w, http.StatusBadRequest, "Invalid JSON format")
+		return
+	}
+
+	videoUuid := expandReq.Uuid
+	if videoUuid == "" || expandReq.Token == "" {
+		h.writeErrorResponse(w, http.StatusBadRequest, "UUID and token are required")
+		return
+	}
+	if len(expandReq.Entries) > structs.MaxExpandEntries {
+		h.writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("At most %d entries can be expanded", structs.MaxExpandEntries))
+		return
+	}
+
+	video, err := h.store.Lookup(ctx, videoUuid)
+	if err != nil {
+		log.Printf("Failed to get video metadata for %s: %v", videoUuid, err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve video metadata")
+		return
+	}
+	// A missing video is left to the store, which reports the attempt as stale
+	videoMeta := map[string]string{}
+	if video != nil {
+		videoMeta = video.Meta
+	}
+	if video != nil && videoMeta["type"] != structs.JobTypeExpand {
+		h.writeErrorResponse(w, http.StatusBadRequest, "Video is not an expand job")
+		return
+	}
+	playlistId, _ := strconv.Atoi(videoMeta["playlist_id"])
+	priority := videoMeta["priority"]
+	// The videos are attributed to whoever added the playlist
+	submitter := structs.Identity{}
+	parentSubmitter := identityFromMeta(videoMeta)
+	if parentSubmitter != nil {
+		submitter = *parentSubmitter
+	}
+
+	response := structs.VideoExpandResponse{
+		Status:  true,
+		Uuid:    videoUuid,
+		Results: make([]structs.VideoAddResult, len(expandReq.Entries)),
+	}
+	now := time.Now()
+	children := make([]*store.Job, 0, len(expandReq.Entries))
+	accepted := make([]int, 0, len(expandReq.Entries))
+	for i, videoID := range expandReq.Entries {
+		response.Results[i].Index = i
+		add, reason := h.prepareVideoAdd(structs.VideoAddRequest{
+			VideoUrl:   "https://www.youtube.com/watch?v=" + url.QueryEscape(videoID),
+			PlaylistId: playlistId,
+			Priority:   priority,
+		}, submitter, now.Unix())
+		if add == nil {
+			response.Results[i].Error = reason
+			response.Rejected++
+			continue
+		}
+		children = append(children, add.job)
+		accepted = append(accepted, i)
+	}
+
+	// The videos also count against the quotas of whoever added the playlist,
+	// and the entries beyond what is left of them are rejected
+	quotaKey, quotaLimits, granted := h.takeSubmitterQuota(ctx, parentSubmitter, len(children), now)
+	for _, i := range accepted[granted:] {
+		response.Results[i].Error = "Quota of the submitter reached"
+		response.Rejected++
+	}
+	children, accepted = children[:granted], accepted[:granted]
+
+	status, results, err := h.store.Expand(ctx, videoUuid, expandReq.Token, children, now)
+	// Entries that were not added, all of them if the expand failed, and
+	// duplicates do not count against the quotas
+	refund := granted
+	if err == nil && status == "ok" {
+		refund = 0
+		for _, result := range results {
+			if result.Duplicate {
+				refund++
+			}
+		}
+	}
+	if refund > 0 && quotaKey != "" {
+		if err := h.limiter.Refund(ctx, quotaKey, refund, quotaLimits, now); err != nil {
+			log.Printf("Failed to refund the quota of %s: %v", quotaKey, err)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to expand video %s: %v", videoUuid, err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to expand video")
+		return
+	}
+	if !h.checkTransition(w, status) {
+		return
+	}
+
+	for n, i := range accepted {
+		response.Results[i].Uuid = results[n].Uuid
+		if results[n].Duplicate {
+			response.Results[i].Duplicate = true
+			response.Duplicates++
+			continue
+		}
+		response.Results[i].State = structs.StateQueued
+		response.Added++
+	}
+
+	h.writeSuccessResponse(w, response)
+}
+
+// takeSubmitterQuota counts the videos of an expand job against the daily and
+// weekly quotas of its submitter and returns the rate limit key and limits it
+// used and how many of the videos fit. Videos of expand jobs added before
+// submitters were recorded are not counted, and all of them fit.
+func (h *Handler) takeSubmitterQuota(ctx context.Context, submitter *structs.Identity, videos int, now time.Time) (string, ratelimit.Limits, int) {
+	if submitter == nil {
+		return "", ratelimit.Limits{}, videos
+	}
+
+	var token *structs.Token
+	if submitter.TokenId != "" {
+		var err error
+		token, err = tokens.Get(ctx, h.rdb, submitter.TokenId)
+		if err != nil {
+			log.Printf("Failed to get token %s: %v", submitter.TokenId, err)
+			return "", ratelimit.Limits{}, videos
+		}
+		if token == nil {
+			// A deleted token keeps the default quotas
+			token = &structs.Token{Id: submitter.TokenId}
+		}
+	}
+
+	key, limits := h.submissionLimits(token, submitter.SourceIp)
+	granted, err := h.limiter.TakeUpTo(ctx, key, videos, limits, now)
+	if err != nil {
+		// Expand jobs keep working when the counters cannot be read
+		log.Printf("Failed to check the quota of %s: %v", key, err)
+		return "", ratelimit.Limits{}, videos
+	}
+	return key, limits, granted
+}
@@ -1,13 +1,21 @@
 package handler
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"firecast/pkg/provider"
+	"firecast/pkg/ratelimit"
+	"firecast/pkg/store"
 	"firecast/pkg/structs"
+	"firecast/pkg/tokens"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
-	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -16,11 +24,21 @@ import (
 	"github.com/redis/go-redis/v9"
 )
 
+// maxClaimWait caps how long GET /video/get?wait= blocks for a video
+const maxClaimWait = 60 * time.Second
+
+// staleAttemptMessage is returned when a worker reports on an attempt that was
+// reclaimed by WipRecovery and possibly handed to another worker
+const staleAttemptMessage = "Video attempt is no longer current"
+
 type Handler struct {
 	rdb             *redis.Client
 	fireCastSecret  string
 	azuraCastAPIKey string
 	azuraCastDomain string
+	store           store.Store
+	providers       *provider.Registry
+	limiter         *ratelimit.Limiter
 }
 
 // Helper methods for JSON responses
@@ -42,59 +60,20 @@ func (h *Handler) writeSuccessResponse(w http.ResponseWriter, data interface{})
 	h.writeJSONResponse(w, http.StatusOK, data)
 }
 
-func NewHandler(rdb *redis.Client, fireCastSecret, azuraCastAPIKey, azuraCastDomain string) *Handler {
+func NewHandler(rdb *redis.Client, jobStore store.Store, fireCastSecret, azuraCastAPIKey, azuraCastDomain string, providers *provider.Registry, limiter *ratelimit.Limiter) *Handler {
 	return &Handler{
 		rdb:             rdb,
 		fireCastSecret:  fireCastSecret,
 		azuraCastAPIKey: azuraCastAPIKey,
 		azuraCastDomain: azuraCastDomain,
+		store:           jobStore,
+		providers:       providers,
+		limiter:         limiter,
 	}
 }
 
-// cleanYouTubeURL cleans a YouTube URL to ensure it's a single video URL
-// If it's a playlist URL with a video, it extracts just the video part
-func (h *Handler) cleanYouTubeURL(videoURL string) (string, error) {
-	parsedURL, err := url.Parse(videoURL)
-	if err != nil {
-		return "", fmt.Errorf("invalid URL format")
-	}
-
-	// Check if it's a YouTube domain
-	if !strings.Contains(parsedURL.Host, "youtube.com") && !strings.Contains(parsedURL.Host, "youtu.be") {
-		return "", fmt.Errorf("only YouTube URLs are allowed")
-	}
-
-	// Handle youtu.be short URLs
-	if strings.Contains(parsedURL.Host, "youtu.be") {
-		videoID := strings.TrimPrefix(parsedURL.Path, "/")
-		if videoID == "" {
-			return "", fmt.Errorf("invalid YouTube video URL")
-		}
-		return fmt.Sprintf("https://www.youtube.com/watch?v=%s", videoID), nil
-	}
-
-	// Handle youtube.com URLs
-	queryParams := parsedURL.Query()
-	videoID := queryParams.Get("v")
-
-	// Check if it's a playlist URL without a video
-	if videoID == "" && queryParams.Get("list") != "" {
-		return "", fmt.Errorf("playlist URLs without a specific video are not allowed")
-	}
-
-	// Check if it's a direct playlist path
-	if strings.Contains(parsedURL.Path, "/playlist") {
-		return "", fmt.Errorf("playlist URLs are not allowed")
-	}
-
-	if videoID == "" {
-		return "", fmt.Errorf("invalid YouTube video URL")
-	}
-
-	// Return clean video URL without playlist parameters
-	return fmt.Sprintf("https://www.youtube.com/watch?v=%s", videoID), nil
-}
-
+// AuthMiddleware accepts FIRECAST_SECRET, which has every scope, or an active
+// named token, and stores the token in the request context for RequireScope
 func (h *Handler) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -105,20 +84,125 @@ func (h *Handler) AuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		token := authHeader
+		secret := authHeader
 		if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
-			token = authHeader[7:]
+			secret = authHeader[7:]
 		}
 
-		if token != h.fireCastSecret {
-			h.writeErrorResponse(w, http.StatusUnauthorized, "Invalid secret")
-			return
+		token := &structs.Token{Name: "secret", Scopes: []string{structs.ScopeAdmin}}
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(h.fireCastSecret)) != 1 {
+			var err error
+			token, err = tokens.Lookup(r.Context(), h.rdb, secret, time.Now())
+			switch {
+			case errors.Is(err, tokens.ErrExpired):
+				h.writeErrorResponse(w, http.StatusUnauthorized, "Token expired")
+				return
+			case errors.Is(err, tokens.ErrInvalid):
+				h.writeErrorResponse(w, http.StatusUnauthorized, "Invalid secret")
+				return
+			case err != nil:
+				log.Printf("Failed to look up token: %v", err)
+				h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to look up token")
+				return
+			}
 		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, token)))
 	})
 }
 
+type tokenContextKey struct{}
+
+// TokenFromContext returns the token a request was authenticated with, or nil
+// outside of AuthMiddleware
+func TokenFromContext(ctx context.Context) *structs.Token {
+	token, _ := ctx.Value(tokenContextKey{}).(*structs.Token)
+	return token
+}
+
+// RequireScope only lets requests through whose token has one of the scopes
+// or the admin scope
+func (h *Handler) RequireScope(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := TokenFromContext(r.Context())
+			if token == nil {
+				h.writeErrorResponse(w, http.StatusUnauthorized, "Authorization required")
+				return
+			}
+			for _, scope := range token.Scopes {
+				if scope == structs.ScopeAdmin || slices.Contains(scopes, scope) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			h.writeErrorResponse(w, http.StatusForbidden, fmt.Sprintf("Token needs the %s scope", strings.Join(scopes, " or ")))
+		})
+	}
+}
+
+// hasScope reports whether the token of a request has a scope or the admin scope
+func hasScope(r *http.Request, scope string) bool {
+	token := TokenFromContext(r.Context())
+	return token != nil && (slices.Contains(token.Scopes, scope) || slices.Contains(token.Scopes, structs.ScopeAdmin))
+}
+
+// allowSubmission counts a request adding the given number of videos against
+// the rate limits of its token, or of its client IP for FIRECAST_SECRET. It
+// writes a 429 with Retry-After and returns false if a limit is exceeded.
+func (h *Handler) allowSubmission(w http.ResponseWriter, r *http.Request, videos int, now time.Time) bool {
+	key, limits := h.submissionLimits(TokenFromContext(r.Context()), clientIP(r))
+	limit, retryAfter, err := h.limiter.Take(r.Context(), key, videos, limits, now)
+	if err != nil {
+		// Submissions keep working when the counters cannot be read
+		log.Printf("Failed to check rate limit of %s: %v", key, err)
+		return true
+	}
+	if limit == "" {
+		return true
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	switch limit {
+	case ratelimit.LimitBurst:
+		h.writeErrorResponse(w, http.StatusTooManyRequests, fmt.Sprintf("Rate limit of %d requests per minute reached", limits.Burst))
+	case ratelimit.LimitDaily:
+		h.writeErrorResponse(w, http.StatusTooManyRequests, fmt.Sprintf("Daily quota of %d videos reached", limits.Daily))
+	default:
+		h.writeErrorResponse(w, http.StatusTooManyRequests, fmt.Sprintf("Weekly quota of %d videos reached", limits.Weekly))
+	}
+	return false
+}
+
+// refundSubmission gives the quota allowSubmission took back for videos that
+// were not added, such as duplicates. The burst limit counts requests and
+// keeps them.
+func (h *Handler) refundSubmission(r *http.Request, videos int, now time.Time) {
+	if videos == 0 {
+		return
+	}
+	key, limits := h.submissionLimits(TokenFromContext(r.Context()), clientIP(r))
+	if err := h.limiter.Refund(r.Context(), key, videos, limits, now); err != nil {
+		log.Printf("Failed to refund the quota of %s: %v", key, err)
+	}
+}
+
+// submissionLimits returns the rate limit key and limits of a token, or of a
+// client IP if the token is nil or FIRECAST_SECRET
+func (h *Handler) submissionLimits(token *structs.Token, ip string) (string, ratelimit.Limits) {
+	limits := h.limiter.Limits
+	if token == nil || token.Id == "" {
+		return "ip:" + ip, limits
+	}
+	if token.DailyQuota > 0 {
+		limits.Daily = token.DailyQuota
+	}
+	if token.WeeklyQuota > 0 {
+		limits.Weekly = token.WeeklyQuota
+	}
+	return "token:" + token.Id, limits
+}
+
 func (h *Handler) HealthzHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	w.Header().Set("Content-Type", "application/json")
@@ -136,6 +220,80 @@ func (h *Handler) HealthzHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// videoAdd is a validated add request and the state it will be stored in
+type videoAdd struct {
+	job   *store.Job
+	state string
+}
+
+// prepareVideoAdd validates an add request and cleans its URL. If the request is
+// invalid, it returns the reason for the caller of the API instead.
+func (h *Handler) prepareVideoAdd(videoReq structs.VideoAddRequest, submitter structs.Identity, now int64) (*videoAdd, string) {
+	if videoReq.VideoUrl == "" || videoReq.PlaylistId == 0 {
+		return nil, "VideoUrl and PlaylistId are required"
+	}
+
+	if videoReq.Priority == "" {
+		videoReq.Priority = structs.PriorityNormal
+	}
+	if !slices.Contains(structs.Priorities, videoReq.Priority) {
+		return nil, fmt.Sprintf("Priority must be one of %s", strings.Join(structs.Priorities, ", "))
+	}
+
+	if videoReq.NotBefore != 0 && videoReq.Delay != 0 {
+		return nil, "Only one of notBefore and delay may be set"
+	}
+	if videoReq.NotBefore < 0 || videoReq.Delay < 0 {
+		return nil, "notBefore and delay must not be negative"
+	}
+
+	// Clean and validate the URL with the provider it belongs to. A playlist
+	// becomes an expand job.
+	media, err := h.providers.Resolve(videoReq.VideoUrl)
+	if err != nil {
+		return nil, fmt.Sprintf("Invalid URL: %s", err.Error())
+	}
+	jobType := structs.JobTypeVideo
+	if media.Playlist {
+		jobType = structs.JobTypeExpand
+	}
+
+	// Videos due in the future wait in the scheduled set until the scheduler promotes them
+	notBefore := videoReq.NotBefore
+	if videoReq.Delay > 0 {
+		notBefore = now + int64(videoReq.Delay)
+	}
+	state := structs.StateQueued
+	if notBefore > now {
+		state = structs.StateScheduled
+	} else {
+		notBefore = 0
+	}
+
+	return &videoAdd{
+		state: state,
+		job: &store.Job{
+			Uuid:       shortuuid.New(),
+			Priority:   videoReq.Priority,
+			IndexField: fmt.Sprintf("%s:%d", media.ID, videoReq.PlaylistId),
+			Force:      videoReq.Force,
+			NotBefore:  notBefore,
+			Meta: append([]interface{}{
+				"type", jobType,
+				"provider", media.Provider,
+				"url", media.URL, // Use the cleaned URL
+				"video_id", media.ID,
+				"playlist_id", videoReq.PlaylistId,
+				"priority", videoReq.Priority,
+				"retries", 0,
+				"added_at", now,
+				"last_attempt_at", now,
+				"not_before", notBefore,
+			}, identityMeta(submitter)...),
+		},
+	}, ""
+}
+
 func (h *Handler) VideoAddHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	w.Header().Set("Content-Type", "application/json")
@@ -146,43 +304,54 @@ func (h *Handler) VideoAddHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if videoReq.VideoUrl == "" || videoReq.PlaylistId == 0 {
-		h.writeErrorResponse(w, http.StatusBadRequest, "VideoUrl and PlaylistId are required")
+	now := time.Now()
+	add, reason := h.prepareVideoAdd(videoReq, identityFromRequest(r), now.Unix())
+	if add == nil {
+		h.writeErrorResponse(w, http.StatusBadRequest, reason)
 		return
 	}
 
-	// Clean and validate the YouTube URL
-	cleanURL, err := h.cleanYouTubeURL(videoReq.VideoUrl)
-	if err != nil {
-		h.writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid YouTube URL: %s", err.Error()))
+	if !h.allowSubmission(w, r, 1, now) {
 		return
 	}
 
-	videoUuid := shortuuid.New()
-
-	if err := h.rdb.LPush(ctx, "videos:queue", videoUuid).Err(); err != nil {
-		log.Printf("Failed to push video request to Redis: %v", err)
+	// Metadata, queue entry and duplicate index are written in one step so a
+	// worker can never claim a uuid whose metadata does not exist yet, and two
+	// concurrent adds of the same video cannot both be queued
+	results, err := h.store.Enqueue(ctx, []*store.Job{add.job}, now)
+	if err != nil {
+		h.refundSubmission(r, 1, now)
+		log.Printf("Failed to store video request: %v", err)
 		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to store video request")
 		return
 	}
 
-	meta := map[string]any{
-		"url":             cleanURL, // Use the cleaned URL
-		"playlist_id":     videoReq.PlaylistId,
-		"retries":         0,
-		"added_at":        time.Now().Unix(),
-		"last_attempt_at": time.Now().Unix(),
-	}
-	if err := h.rdb.HSet(ctx, fmt.Sprintf("videos:meta:%s", videoUuid), meta).Err(); err != nil {
-		log.Printf("Failed to set video metadata: %v", err)
-		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to store video metadata")
+	if results[0].Duplicate {
+		h.refundSubmission(r, 1, now)
+		existingUuid := results[0].Uuid
+		state, err := h.store.State(ctx, existingUuid)
+		if err != nil {
+			log.Printf("Failed to get state of video %s: %v", existingUuid, err)
+			h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to get video state")
+			return
+		}
+
+		h.writeSuccessResponse(w, map[string]interface{}{
+			"status":    true,
+			"message":   "Video was already added",
+			"uuid":      existingUuid,
+			"duplicate": true,
+			"state":     state,
+		})
 		return
 	}
 
 	h.writeSuccessResponse(w, map[string]interface{}{
-		"status":  true,
-		"message": "ok",
-		"uuid":    videoUuid,
+		"status":    true,
+		"message":   "ok",
+		"uuid":      add.job.Uuid,
+		"duplicate": false,
+		"state":     add.state,
 	})
 }
 
@@ -190,59 +359,168 @@ func (h *Handler) VideoGetHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	w.Header().Set("Content-Type", "application/json")
 
-	videoUuid, err := h.rdb.RPop(ctx, "videos:queue").Result()
+	// Workers may name themselves so the event log shows who claimed a video
+	worker := r.URL.Query().Get("worker")
+
+	wait, err := parseWait(r.URL.Query().Get("wait"))
 	if err != nil {
-		if err == redis.Nil {
+		h.writeErrorResponse(w, http.StatusBadRequest, "wait must be a duration such as 30s")
+		return
+	}
+	waitUntil := time.Now().Add(wait)
+
+	var claim *store.Claim
+	var attemptToken string
+	for {
+		// Every claim gets a fresh token that fences off completions from older attempts
+		attemptToken = shortuuid.New()
+		claim, err = h.store.Claim(ctx, attemptToken, worker, time.Now())
+		if err != nil || claim != nil {
+			break
+		}
+
+		remaining := time.Until(waitUntil)
+		if remaining <= 0 {
 			// 204 No Content should not have a body
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
-		log.Printf("Failed to pop video request from Redis: %v", err)
-		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to pop video request from Redis")
+
+		// Block until a video is queued or the wait is over, then try again
+		if err := h.store.Wait(ctx, remaining); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Failed to wait for a video: %v", err)
+			h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to claim video")
+			return
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to claim video: %v", err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to claim video")
+		return
+	}
+
+	videoUuid := claim.Uuid
+	if claim.Meta == nil {
+		log.Printf("Video %s has no metadata, moved to fail set", videoUuid)
+		h.writeErrorResponse(w, http.StatusNotFound, "Video metadata not found")
 		return
 	}
+	videoData := claim.Meta
+
+	retries, _ := strconv.Atoi(videoData["retries"])
+	addedAt, _ := strconv.ParseInt(videoData["added_at"], 10, 64)
+	lastAttemptAt, _ := strconv.ParseInt(videoData["last_attempt_at"], 10, 64)
+	playlistId, _ := strconv.Atoi(videoData["playlist_id"])
+	notBefore, _ := strconv.ParseInt(videoData["not_before"], 10, 64)
+
+	jobType := videoData["type"]
+	if jobType == "" {
+		jobType = structs.JobTypeVideo
+	}
+
+	videoResponse := structs.VideoResponse{
+		Uuid:           videoUuid,
+		Token:          attemptToken,
+		Type:           jobType,
+		VideoUrl:       videoData["url"],
+		PlaylistId:     playlistId,
+		Priority:       videoData["priority"],
+		Retries:        retries,
+		AddedAt:        addedAt,
+		LastAttemptAt:  lastAttemptAt,
+		LeaseExpiresAt: claim.LeaseExpiresAt,
+		NotBefore:      notBefore,
+	}
+	h.writeSuccessResponse(w, videoResponse)
+}
+
+// parseWait reads the wait parameter of /video/get, either a duration such as
+// 30s or a number of seconds, capped at maxClaimWait
+func parseWait(waitStr string) (time.Duration, error) {
+	if waitStr == "" {
+		return 0, nil
+	}
 
-	videoData, err := h.rdb.HGetAll(ctx, fmt.Sprintf("videos:meta:%s", videoUuid)).Result()
+	wait, err := time.ParseDuration(waitStr)
 	if err != nil {
-		log.Printf("Failed to get video metadata from Redis: %v", err)
-		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve video metadata")
+		seconds, atoiErr := strconv.Atoi(waitStr)
+		if atoiErr != nil {
+			return 0, err
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+	if wait < 0 {
+		return 0, fmt.Errorf("wait must not be negative")
+	}
+	return min(wait, maxClaimWait), nil
+}
+
+// VideoHeartbeatHandler extends the lease of an in-progress video so that
+// WipRecovery does not hand it to another worker while it is still being processed
+func (h *Handler) VideoHeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json")
+
+	var heartbeatReq structs.VideoHeartbeatRequest
+	if err := json.NewDecoder(r.Body).Decode(&heartbeatReq); err != nil {
+		h.writeErrorResponse(w, http.StatusBadRequest, "Invalid JSON format")
 		return
 	}
 
-	if len(videoData) == 0 {
-		h.writeErrorResponse(w, http.StatusNotFound, "Video metadata not found")
+	videoUuid := heartbeatReq.Uuid
+	if videoUuid == "" || heartbeatReq.Token == "" {
+		h.writeErrorResponse(w, http.StatusBadRequest, "UUID and token are required")
 		return
 	}
 
-	if err := h.rdb.ZAdd(ctx, "videos:wip", redis.Z{
-		Score:  float64(time.Now().Unix() + 60),
-		Member: videoUuid,
-	}).Err(); err != nil {
-		log.Printf("Failed to add video to wip: %v", err)
-		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to add video to wip")
+	if heartbeatReq.Stage != "" && !slices.Contains(structs.Stages, heartbeatReq.Stage) {
+		h.writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Stage must be one of %s", strings.Join(structs.Stages, ", ")))
 		return
 	}
 
-	if _, err := h.rdb.HIncrBy(ctx, fmt.Sprintf("videos:meta:%s", videoUuid), "retries", 1).Result(); err != nil {
-		log.Printf("Failed to increment retry count for video %s: %v", videoUuid, err)
-		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to increment retry count")
+	status, leaseDeadline, err := h.store.Heartbeat(ctx, videoUuid, heartbeatReq.Token, heartbeatReq.Stage, time.Now())
+	if err != nil {
+		log.Printf("Failed to extend lease for video %s: %v", videoUuid, err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to extend lease")
+		return
+	}
+	if !h.checkTransition(w, status) {
 		return
 	}
 
-	retries, _ := strconv.Atoi(videoData["retries"])
-	addedAt, _ := strconv.ParseInt(videoData["added_at"], 10, 64)
-	lastAttemptAt, _ := strconv.ParseInt(videoData["last_attempt_at"], 10, 64)
-	playlistId, _ := strconv.Atoi(videoData["playlist_id"])
+	h.writeSuccessResponse(w, structs.VideoHeartbeatResponse{
+		Status:         true,
+		Uuid:           videoUuid,
+		LeaseExpiresAt: leaseDeadline,
+	})
+}
 
-	videoResponse := structs.VideoResponse{
-		Uuid:          videoUuid,
-		VideoUrl:      videoData["url"],
-		PlaylistId:    playlistId,
-		Retries:       retries + 1,
-		AddedAt:       addedAt,
-		LastAttemptAt: lastAttemptAt,
+// checkTransition writes the conflict response for a rejected state transition
+// and reports whether the transition went through
+func (h *Handler) checkTransition(w http.ResponseWriter, status string) bool {
+	switch status {
+	case "stale":
+		h.writeErrorResponse(w, http.StatusConflict, staleAttemptMessage)
+		return false
+	case "done":
+		h.writeErrorResponse(w, http.StatusConflict, "Already marked as done")
+		return false
+	case "fail":
+		h.writeErrorResponse(w, http.StatusConflict, "Already marked as failed")
+		return false
+	case "not_wip":
+		h.writeErrorResponse(w, http.StatusConflict, "Video is not in progress")
+		return false
+	case "cancelled":
+		// 410 tells the worker to stop rather than retry
+		h.writeErrorResponse(w, http.StatusGone, "Video was cancelled")
+		return false
 	}
-	h.writeSuccessResponse(w, videoResponse)
+
+	return true
 }
 
 func (h *Handler) VideoFailHandler(w http.ResponseWriter, r *http.Request) {
@@ -256,42 +534,50 @@ func (h *Handler) VideoFailHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	videoUuid := failReq.Uuid
-	if videoUuid == "" {
-		h.writeErrorResponse(w, http.StatusBadRequest, "UUID is required")
+	if videoUuid == "" || failReq.Token == "" {
+		h.writeErrorResponse(w, http.StatusBadRequest, "UUID and token are required")
 		return
 	}
 
-	isFailed, err := h.rdb.SIsMember(ctx, "videos:fail", videoUuid).Result()
-	if err != nil {
-		log.Printf("Failed to check fail set: %v", err)
-		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to check fail set")
+	if failReq.Stage != "" && !slices.Contains(structs.Stages, failReq.Stage) {
+		h.writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Stage must be one of %s", strings.Join(structs.Stages, ", ")))
 		return
 	}
-	if isFailed {
-		h.writeErrorResponse(w, http.StatusConflict, "Already marked as failed")
+	if failReq.Class == "" {
+		failReq.Class = structs.ClassPermanent
+	}
+	if failReq.Class != structs.ClassTransient && failReq.Class != structs.ClassPermanent {
+		h.writeErrorResponse(w, http.StatusBadRequest, "Class must be one of transient, permanent")
 		return
 	}
 
-	isDone, err := h.rdb.SIsMember(ctx, "videos:done", videoUuid).Result()
+	// Transient failures go back through the retry policy until retries run out
+	status, nextAttemptAt, err := h.store.Fail(ctx, videoUuid, failReq.Token, store.Failure{
+		Error: failReq.Error,
+		Stage: failReq.Stage,
+		Class: failReq.Class,
+	}, time.Now())
 	if err != nil {
-		log.Printf("Failed to check done set: %v", err)
-		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to check done set")
-		return
-	}
-	if isDone {
-		h.writeErrorResponse(w, http.StatusConflict, "Already marked as done")
+		log.Printf("Failed to mark video %s as failed: %v", videoUuid, err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to update video state")
 		return
 	}
-
-	if err := h.rdb.ZRem(ctx, "videos:wip", videoUuid).Err(); err != nil {
-		log.Printf("Failed to remove video from wip: %v", err)
-		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to remove video from wip")
+	if !h.checkTransition(w, status) {
 		return
 	}
 
-	if err := h.rdb.SAdd(ctx, "videos:fail", videoUuid).Err(); err != nil {
-		log.Printf("Failed to add video to failed set: %v", err)
-		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to add video to failed set")
+	if status == "queue" || status == "scheduled" {
+		state := structs.StateScheduled
+		if status == "queue" {
+			state = structs.StateQueued
+		}
+		h.writeSuccessResponse(w, map[string]interface{}{
+			"status":    true,
+			"message":   "Video scheduled for retry",
+			"uuid":      videoUuid,
+			"state":     state,
+			"notBefore": nextAttemptAt,
+		})
 		return
 	}
 
@@ -299,6 +585,7 @@ func (h *Handler) VideoFailHandler(w http.ResponseWriter, r *http.Request) {
 		"status":  true,
 		"message": "Video marked as failed",
 		"uuid":    videoUuid,
+		"state":   structs.StateFail,
 	})
 }
 
@@ -313,42 +600,18 @@ func (h *Handler) VideoDoneHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	videoUuid := doneReq.Uuid
-	if videoUuid == "" {
-		h.writeErrorResponse(w, http.StatusBadRequest, "UUID is required")
+	if videoUuid == "" || doneReq.Token == "" {
+		h.writeErrorResponse(w, http.StatusBadRequest, "UUID and token are required")
 		return
 	}
 
-	isDone, err := h.rdb.SIsMember(ctx, "videos:done", videoUuid).Result()
+	status, err := h.store.Complete(ctx, videoUuid, doneReq.Token, time.Now())
 	if err != nil {
-		log.Printf("Failed to check done set: %v", err)
-		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to check done set")
+		log.Printf("Failed to mark video %s as done: %v", videoUuid, err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to update video state")
 		return
 	}
-	if isDone {
-		h.writeErrorResponse(w, http.StatusConflict, "Already marked as done")
-		return
-	}
-
-	isFailed, err := h.rdb.SIsMember(ctx, "videos:fail", videoUuid).Result()
-	if err != nil {
-		log.Printf("Failed to check fail set: %v", err)
-		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to check fail set")
-		return
-	}
-	if isFailed {
-		h.writeErrorResponse(w, http.StatusConflict, "Already marked as failed")
-		return
-	}
-
-	if err := h.rdb.ZRem(ctx, "videos:wip", videoUuid).Err(); err != nil {
-		log.Printf("Failed to remove video from wip: %v", err)
-		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to remove video from wip")
-		return
-	}
-
-	if err := h.rdb.SAdd(ctx, "videos:done", videoUuid).Err(); err != nil {
-		log.Printf("Failed to add video to done set: %v", err)
-		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to mark video as done")
+	if !h.checkTransition(w, status) {
 		return
 	}
 
@@ -362,39 +625,27 @@ func (h *Handler) StatusHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	w.Header().Set("Content-Type", "application/json")
 
-	wipCount, err := h.rdb.ZCard(ctx, "videos:wip").Result()
+	stats, err := h.store.Stats(ctx)
 	if err != nil {
-		log.Printf("Failed to get wip count: %v", err)
-		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to get wip count")
+		log.Printf("Failed to get video counts: %v", err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to get video counts")
 		return
 	}
 
-	doneCount, err := h.rdb.SCard(ctx, "videos:done").Result()
-	if err != nil {
-		log.Printf("Failed to get done count: %v", err)
-		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to get done count")
-		return
-	}
-
-	failedCount, err := h.rdb.SCard(ctx, "videos:fail").Result()
-	if err != nil {
-		log.Printf("Failed to get failed count: %v", err)
-		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to get failed count")
-		return
-	}
-
-	queueLength, err := h.rdb.LLen(ctx, "videos:queue").Result()
-	if err != nil {
-		log.Printf("Failed to get queue length: %v", err)
-		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to get queue length")
-		return
+	queueLength := 0
+	for _, length := range stats.QueueByPriority {
+		queueLength += length
 	}
 
 	statusResponse := structs.StatusResponse{
-		WipCount:    int(wipCount),
-		DoneCount:   int(doneCount),
-		FailCount:   int(failedCount),
-		QueueLength: int(queueLength),
+		WipCount:        stats.Wip,
+		DoneCount:       stats.Done,
+		FailCount:       stats.Fail,
+		QueueLength:     queueLength,
+		QueueByPriority: stats.QueueByPriority,
+		ScheduledCount:  stats.Scheduled,
+		Janitor:         stats.Janitor,
+		Providers:       h.providers.Names(),
 	}
 	h.writeSuccessResponse(w, statusResponse)
 }
@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"firecast/pkg/store"
+	"firecast/pkg/structs"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+func parseListFilter(r *http.Request) (store.ListFilter, error) {
+	query := r.URL.Query()
+	filter := store.ListFilter{
+		Cursor: query.Get("cursor"),
+		Limit:  defaultListLimit,
+	}
+
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			return filter, fmt.Errorf("limit must be a positive number")
+		}
+		filter.Limit = min(limit, maxListLimit)
+	}
+
+	if playlistIdStr := query.Get("playlistId"); playlistIdStr != "" {
+		playlistId, err := strconv.Atoi(playlistIdStr)
+		if err != nil {
+			return filter, fmt.Errorf("playlistId must be a number")
+		}
+		filter.PlaylistId = playlistId
+	}
+
+	filter.Class = query.Get("class")
+
+	for name, target := range map[string]*int64{"from": &filter.From, "to": &filter.To} {
+		if valueStr := query.Get(name); valueStr != "" {
+			value, err := strconv.ParseInt(valueStr, 10, 64)
+			if err != nil {
+				return filter, fmt.Errorf("%s must be a unix timestamp", name)
+			}
+			*target = value
+		}
+	}
+
+	return filter, nil
+}
+
+// writeVideoList answers a /status/* listing of the videos in one state
+func (h *Handler) writeVideoList(w http.ResponseWriter, r *http.Request, state string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	filter, err := parseListFilter(r)
+	if err != nil {
+		h.writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	page, err := h.store.List(r.Context(), state, filter)
+	if err == store.ErrInvalidCursor {
+		h.writeErrorResponse(w, http.StatusBadRequest, "Invalid cursor")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to list videos: %v", err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to list videos")
+		return
+	}
+
+	response := structs.VideoListResponse{
+		Videos:     make([]*structs.VideoDetailResponse, 0, len(page.Videos)),
+		NextCursor: page.NextCursor,
+	}
+	admin := hasScope(r, structs.ScopeAdmin)
+	for _, video := range page.Videos {
+		response.Videos = append(response.Videos, detailFromVideo(video, admin))
+	}
+	h.writeSuccessResponse(w, response)
+}
+
+// StatusQueueHandler lists queued videos in the order they will be claimed
+func (h *Handler) StatusQueueHandler(w http.ResponseWriter, r *http.Request) {
+	h.writeVideoList(w, r, structs.StateQueued)
+}
+
+// StatusScheduledHandler lists scheduled videos by the time they become due
+func (h *Handler) StatusScheduledHandler(w http.ResponseWriter, r *http.Request) {
+	h.writeVideoList(w, r, structs.StateScheduled)
+}
+
+// StatusWipHandler lists in-progress videos by lease deadline
+func (h *Handler) StatusWipHandler(w http.ResponseWriter, r *http.Request) {
+	h.writeVideoList(w, r, structs.StateWip)
+}
+
+// StatusDoneHandler lists finished videos, oldest first
+func (h *Handler) StatusDoneHandler(w http.ResponseWriter, r *http.Request) {
+	h.writeVideoList(w, r, structs.StateDone)
+}
+
+// StatusFailHandler lists failed videos, oldest first
+func (h *Handler) StatusFailHandler(w http.ResponseWriter, r *http.Request) {
+	h.writeVideoList(w, r, structs.StateFail)
+}
@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"firecast/pkg/store"
+	"firecast/pkg/structs"
+)
+
+// retryVideo moves one failed video back into the queue and describes the outcome
+func (h *Handler) retryVideo(ctx context.Context, videoUuid string, resetRetries bool) (structs.VideoRetryResult, error) {
+	status, err := h.store.Retry(ctx, videoUuid, resetRetries, time.Now())
+	if err != nil {
+		return structs.VideoRetryResult{}, err
+	}
+
+	result := structs.VideoRetryResult{Uuid: videoUuid, Retried: status == "ok"}
+	switch status {
+	case "not_failed":
+		result.Message = "Video is not in the fail set"
+	case "missing":
+		result.Message = "Video not found"
+	}
+	return result, nil
+}
+
+// VideoRetryHandler moves one or many failed videos back into the queue
+func (h *Handler) VideoRetryHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json")
+
+	var retryReq structs.VideoRetryRequest
+	if err := json.NewDecoder(r.Body).Decode(&retryReq); err != nil {
+		h.writeErrorResponse(w, http.StatusBadRequest, "Invalid JSON format")
+		return
+	}
+
+	uuids := retryReq.Uuids
+	if len(uuids) == 0 {
+		filter := store.ListFilter{
+			Limit:      maxListLimit,
+			PlaylistId: retryReq.PlaylistId,
+			Class:      retryReq.Class,
+			From:       retryReq.From,
+			To:         retryReq.To,
+		}
+		if !retryReq.All && filter.PlaylistId == 0 && filter.Class == "" && filter.From == 0 && filter.To == 0 {
+			h.writeErrorResponse(w, http.StatusBadRequest, "Uuids, a filter or all is required")
+			return
+		}
+
+		// Collect the selection first so retried videos do not affect paging
+		for {
+			page, err := h.store.List(ctx, structs.StateFail, filter)
+			if err != nil {
+				log.Printf("Failed to list failed videos: %v", err)
+				h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to list failed videos")
+				return
+			}
+			for _, video := range page.Videos {
+				uuids = append(uuids, video.Uuid)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			filter.Cursor = page.NextCursor
+		}
+	}
+
+	response := structs.VideoRetryResponse{
+		Status:  true,
+		Results: make([]structs.VideoRetryResult, 0, len(uuids)),
+	}
+	for _, videoUuid := range uuids {
+		result, err := h.retryVideo(ctx, videoUuid, retryReq.ResetRetries)
+		if err != nil {
+			// The videos before it were already retried, so report each outcome
+			log.Printf("Failed to retry video %s: %v", videoUuid, err)
+			result = structs.VideoRetryResult{Uuid: videoUuid, Message: "Failed to retry video"}
+			response.Failed++
+		}
+		if result.Retried {
+			response.Retried++
+			h.audit(r, structs.AuditVideoRetry, videoUuid, map[string]string{
+				"resetRetries": strconv.FormatBool(retryReq.ResetRetries),
+			})
+		}
+		response.Results = append(response.Results, result)
+	}
+
+	h.writeSuccessResponse(w, response)
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"firecast/pkg/events"
+	"firecast/pkg/structs"
+)
+
+// streamKeepAlive is how often an idle event stream sends a comment, so proxies
+// do not close the connection
+const streamKeepAlive = 15 * time.Second
+
+// EventsHandler streams video events as server-sent events. The stream can be
+// limited to one video with ?uuid=, to one playlist with ?playlistId= and to
+// a comma separated list of event types with ?type=.
+func (h *Handler) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	query := r.URL.Query()
+	videoUuid := query.Get("uuid")
+	playlistId := 0
+	if playlistIdStr := query.Get("playlistId"); playlistIdStr != "" {
+		var err error
+		playlistId, err = strconv.Atoi(playlistIdStr)
+		if err != nil {
+			h.writeErrorResponse(w, http.StatusBadRequest, "playlistId must be a number")
+			return
+		}
+	}
+	var types []string
+	if typeStr := query.Get("type"); typeStr != "" {
+		types = strings.Split(typeStr, ",")
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Streaming not supported")
+		return
+	}
+
+	pubsub := h.rdb.Subscribe(ctx, events.Channel)
+	defer func() {
+		if err := pubsub.Close(); err != nil {
+			log.Printf("Warning: failed to close event subscription: %v", err)
+		}
+	}()
+	// Wait for the subscription to be confirmed so no event published after
+	// the response starts is missed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		log.Printf("Failed to subscribe to events: %v", err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to subscribe to events")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+
+			var event structs.VideoEvent
+			if err := json.Unmarshal([]byte(message.Payload), &event); err != nil {
+				log.Printf("Skipping malformed event: %v", err)
+				continue
+			}
+			if videoUuid != "" && event.Uuid != videoUuid {
+				continue
+			}
+			if playlistId != 0 && event.PlaylistId != playlistId {
+				continue
+			}
+			if len(types) > 0 && !slices.Contains(types, event.Type) {
+				continue
+			}
+
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, message.Payload); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
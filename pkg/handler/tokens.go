@@ -0,0 +1,178 @@
+package handler
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"firecast/pkg/structs"
+	"firecast/pkg/tokens"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lithammer/shortuuid/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// TokenCreateHandler creates a named API token and returns its secret, which
+// cannot be read again later
+func (h *Handler) TokenCreateHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json")
+
+	var tokenReq structs.TokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&tokenReq); err != nil {
+		h.writeErrorResponse(w, http.StatusBadRequest, "Invalid JSON format")
+		return
+	}
+
+	tokenReq.Name = strings.TrimSpace(tokenReq.Name)
+	if tokenReq.Name == "" {
+		h.writeErrorResponse(w, http.StatusBadRequest, "Name is required")
+		return
+	}
+	if len(tokenReq.Scopes) == 0 {
+		h.writeErrorResponse(w, http.StatusBadRequest, "Scopes are required")
+		return
+	}
+	for _, scope := range tokenReq.Scopes {
+		if !slices.Contains(structs.Scopes, scope) {
+			h.writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Scopes must be any of %s", strings.Join(structs.Scopes, ", ")))
+			return
+		}
+	}
+	if tokenReq.ExpiresIn < 0 || tokenReq.DailyQuota < 0 || tokenReq.WeeklyQuota < 0 {
+		h.writeErrorResponse(w, http.StatusBadRequest, "ExpiresIn and quotas must not be negative")
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Printf("Failed to generate token secret: %v", err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to generate token secret")
+		return
+	}
+
+	now := time.Now().Unix()
+	token := structs.Token{
+		Id:          shortuuid.New(),
+		Name:        tokenReq.Name,
+		Scopes:      tokenReq.Scopes,
+		Secret:      hex.EncodeToString(secret),
+		CreatedAt:   now,
+		DailyQuota:  tokenReq.DailyQuota,
+		WeeklyQuota: tokenReq.WeeklyQuota,
+	}
+	if tokenReq.ExpiresIn > 0 {
+		token.ExpiresAt = now + tokenReq.ExpiresIn
+	}
+
+	_, err := h.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, tokens.TokenKey(token.Id),
+			"name", token.Name,
+			"scopes", strings.Join(token.Scopes, ","),
+			"hash", tokens.Hash(token.Secret),
+			"created_at", token.CreatedAt,
+			"expires_at", token.ExpiresAt,
+			"daily_quota", token.DailyQuota,
+			"weekly_quota", token.WeeklyQuota,
+		)
+		pipe.HSet(ctx, tokens.IndexKey, tokens.Hash(token.Secret), token.Id)
+		pipe.SAdd(ctx, tokens.SetKey, token.Id)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to store token: %v", err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to store token")
+		return
+	}
+
+	h.audit(r, structs.AuditTokenCreate, token.Id, map[string]string{
+		"name":   token.Name,
+		"scopes": strings.Join(token.Scopes, ","),
+	})
+	h.writeJSONResponse(w, http.StatusCreated, token)
+}
+
+// TokenListHandler lists all tokens, revoked ones included, without their secrets
+func (h *Handler) TokenListHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json")
+
+	ids, err := h.rdb.SMembers(ctx, tokens.SetKey).Result()
+	if err != nil {
+		log.Printf("Failed to list tokens: %v", err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to list tokens")
+		return
+	}
+
+	pipe := h.rdb.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.HGetAll(ctx, tokens.TokenKey(id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to list tokens: %v", err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to list tokens")
+		return
+	}
+
+	response := structs.TokenListResponse{Tokens: make([]structs.Token, 0, len(ids))}
+	for i, cmd := range cmds {
+		if len(cmd.Val()) == 0 {
+			continue
+		}
+		response.Tokens = append(response.Tokens, tokens.FromHash(ids[i], cmd.Val()))
+	}
+	slices.SortFunc(response.Tokens, func(a, b structs.Token) int {
+		return cmp.Or(cmp.Compare(a.CreatedAt, b.CreatedAt), strings.Compare(a.Id, b.Id))
+	})
+
+	h.writeSuccessResponse(w, response)
+}
+
+// TokenRevokeHandler revokes a token right away. It stays listed with the
+// time it was revoked.
+func (h *Handler) TokenRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json")
+
+	id := chi.URLParam(r, "id")
+	hash, err := h.rdb.HGetAll(ctx, tokens.TokenKey(id)).Result()
+	if err != nil {
+		log.Printf("Failed to get token %s: %v", id, err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to revoke token")
+		return
+	}
+	if len(hash) == 0 {
+		h.writeErrorResponse(w, http.StatusNotFound, "Token not found")
+		return
+	}
+	if hash["revoked_at"] != "" {
+		h.writeErrorResponse(w, http.StatusConflict, "Token already revoked")
+		return
+	}
+
+	_, err = h.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, tokens.TokenKey(id), "revoked_at", time.Now().Unix())
+		pipe.HDel(ctx, tokens.IndexKey, hash["hash"])
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to revoke token %s: %v", id, err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to revoke token")
+		return
+	}
+
+	h.audit(r, structs.AuditTokenRevoke, id, map[string]string{"name": hash["name"]})
+	h.writeSuccessResponse(w, map[string]interface{}{
+		"status":  true,
+		"message": "Token revoked",
+	})
+}
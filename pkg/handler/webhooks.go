@@ -0,0 +1,233 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"firecast/pkg/structs"
+	"firecast/pkg/webhooks"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lithammer/shortuuid/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultWebhookEvents are delivered when a subscription does not list any
+var defaultWebhookEvents = []string{structs.EventDone, structs.EventFailed}
+
+func webhookFromHash(id string, hook map[string]string) structs.Webhook {
+	createdAt, _ := strconv.ParseInt(hook["created_at"], 10, 64)
+	return structs.Webhook{
+		Id:        id,
+		Url:       hook["url"],
+		Events:    strings.Split(hook["events"], ","),
+		CreatedAt: createdAt,
+	}
+}
+
+// WebhookCreateHandler subscribes a URL to video events
+func (h *Handler) WebhookCreateHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json")
+
+	var webhookReq structs.WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&webhookReq); err != nil {
+		h.writeErrorResponse(w, http.StatusBadRequest, "Invalid JSON format")
+		return
+	}
+
+	target, err := url.Parse(webhookReq.Url)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		h.writeErrorResponse(w, http.StatusBadRequest, "Url must be an absolute http or https URL")
+		return
+	}
+
+	if len(webhookReq.Events) == 0 {
+		webhookReq.Events = defaultWebhookEvents
+	}
+	for _, eventType := range webhookReq.Events {
+		if !slices.Contains(structs.EventTypes, eventType) {
+			h.writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Events must be any of %s", strings.Join(structs.EventTypes, ", ")))
+			return
+		}
+	}
+
+	if webhookReq.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Printf("Failed to generate webhook secret: %v", err)
+			h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to generate webhook secret")
+			return
+		}
+		webhookReq.Secret = hex.EncodeToString(secret)
+	}
+
+	webhook := structs.Webhook{
+		Id:        shortuuid.New(),
+		Url:       webhookReq.Url,
+		Events:    webhookReq.Events,
+		Secret:    webhookReq.Secret,
+		CreatedAt: time.Now().Unix(),
+	}
+	_, err = h.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, webhooks.HookKey(webhook.Id),
+			"url", webhook.Url,
+			"events", strings.Join(webhook.Events, ","),
+			"secret", webhook.Secret,
+			"created_at", webhook.CreatedAt,
+		)
+		pipe.SAdd(ctx, "webhooks", webhook.Id)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to store webhook: %v", err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to store webhook")
+		return
+	}
+
+	h.audit(r, structs.AuditWebhookCreate, webhook.Id, map[string]string{
+		"url":    webhook.Url,
+		"events": strings.Join(webhook.Events, ","),
+	})
+	h.writeJSONResponse(w, http.StatusCreated, webhook)
+}
+
+// WebhookListHandler lists all webhook subscriptions, without their secrets
+func (h *Handler) WebhookListHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json")
+
+	ids, err := h.rdb.SMembers(ctx, "webhooks").Result()
+	if err != nil {
+		log.Printf("Failed to list webhooks: %v", err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to list webhooks")
+		return
+	}
+	slices.Sort(ids)
+
+	response := structs.WebhookListResponse{Webhooks: make([]structs.Webhook, 0, len(ids))}
+	for _, id := range ids {
+		hook, err := h.rdb.HGetAll(ctx, webhooks.HookKey(id)).Result()
+		if err != nil {
+			log.Printf("Failed to get webhook %s: %v", id, err)
+			h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to list webhooks")
+			return
+		}
+		if len(hook) == 0 {
+			continue
+		}
+		response.Webhooks = append(response.Webhooks, webhookFromHash(id, hook))
+	}
+
+	h.writeSuccessResponse(w, response)
+}
+
+// WebhookDeleteHandler removes a webhook subscription and its delivery log.
+// Pending deliveries are dropped by the dispatcher.
+func (h *Handler) WebhookDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json")
+
+	id := chi.URLParam(r, "id")
+	removed, err := h.rdb.SRem(ctx, "webhooks", id).Result()
+	if err != nil {
+		log.Printf("Failed to delete webhook %s: %v", id, err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to delete webhook")
+		return
+	}
+	if removed == 0 {
+		h.writeErrorResponse(w, http.StatusNotFound, "Webhook not found")
+		return
+	}
+
+	if err := h.rdb.Del(ctx, webhooks.HookKey(id), webhooks.LogKey(id)).Err(); err != nil {
+		log.Printf("Failed to delete webhook %s: %v", id, err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to delete webhook")
+		return
+	}
+
+	h.audit(r, structs.AuditWebhookDelete, id, nil)
+	h.writeSuccessResponse(w, map[string]interface{}{
+		"status":  true,
+		"message": "Webhook deleted",
+	})
+}
+
+// WebhookDeliveriesHandler returns the most recent deliveries of a webhook, newest first
+func (h *Handler) WebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json")
+
+	id := chi.URLParam(r, "id")
+	exists, err := h.rdb.SIsMember(ctx, "webhooks", id).Result()
+	if err != nil {
+		log.Printf("Failed to get webhook %s: %v", id, err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to get webhook")
+		return
+	}
+	if !exists {
+		h.writeErrorResponse(w, http.StatusNotFound, "Webhook not found")
+		return
+	}
+
+	deliveryIds, err := h.rdb.LRange(ctx, webhooks.LogKey(id), 0, -1).Result()
+	if err != nil {
+		log.Printf("Failed to get deliveries of webhook %s: %v", id, err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to get deliveries")
+		return
+	}
+
+	pipe := h.rdb.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(deliveryIds))
+	for i, deliveryId := range deliveryIds {
+		cmds[i] = pipe.HGetAll(ctx, webhooks.DeliveryKey(deliveryId))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to get deliveries of webhook %s: %v", id, err)
+		h.writeErrorResponse(w, http.StatusInternalServerError, "Failed to get deliveries")
+		return
+	}
+
+	response := structs.WebhookDeliveriesResponse{
+		WebhookId:  id,
+		Deliveries: make([]structs.WebhookDelivery, 0, len(deliveryIds)),
+	}
+	for i, cmd := range cmds {
+		// Finished deliveries expire, leaving their id behind in the log
+		delivery := cmd.Val()
+		if len(delivery) == 0 {
+			continue
+		}
+		attempts, _ := strconv.Atoi(delivery["attempts"])
+		lastStatusCode, _ := strconv.Atoi(delivery["last_status_code"])
+		createdAt, _ := strconv.ParseInt(delivery["created_at"], 10, 64)
+		lastAttemptAt, _ := strconv.ParseInt(delivery["last_attempt_at"], 10, 64)
+		nextAttemptAt, _ := strconv.ParseInt(delivery["next_attempt_at"], 10, 64)
+		deliveredAt, _ := strconv.ParseInt(delivery["delivered_at"], 10, 64)
+		response.Deliveries = append(response.Deliveries, structs.WebhookDelivery{
+			Id:             deliveryIds[i],
+			WebhookId:      id,
+			Event:          delivery["event"],
+			Uuid:           delivery["uuid"],
+			Status:         delivery["status"],
+			Attempts:       attempts,
+			LastStatusCode: lastStatusCode,
+			LastError:      delivery["last_error"],
+			CreatedAt:      createdAt,
+			LastAttemptAt:  lastAttemptAt,
+			NextAttemptAt:  nextAttemptAt,
+			DeliveredAt:    deliveredAt,
+		})
+	}
+
+	h.writeSuccessResponse(w, response)
+}
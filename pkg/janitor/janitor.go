@@ -0,0 +1,69 @@
+package janitor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"firecast/pkg/store"
+	"firecast/pkg/structs"
+
+	"github.com/joho/godotenv"
+)
+
+// Janitor periodically prunes done and failed videos older than their retention
+// period. DONE_RETENTION and FAIL_RETENTION are in seconds, 0 keeps videos forever.
+// Pruning counts are recorded by the store for the status API.
+func Janitor(ctx context.Context, jobStore store.Store) {
+
+	err := godotenv.Load()
+	if err != nil {
+		fmt.Println("Error loading .env file - using environment variables")
+	}
+
+	retention := map[string]int{
+		structs.StateDone: envSeconds("DONE_RETENTION", 7*24*60*60),
+		structs.StateFail: envSeconds("FAIL_RETENTION", 30*24*60*60),
+	}
+	janitorFrequency := envSeconds("JANITOR_INTERVAL", 60)
+
+	go func() {
+		for {
+			now := time.Now()
+			cutoffs := map[string]int64{}
+			for state, seconds := range retention {
+				if seconds > 0 {
+					cutoffs[state] = now.Unix() - int64(seconds)
+				}
+			}
+
+			pruned, err := jobStore.Prune(ctx, cutoffs, now)
+			if err != nil {
+				log.Printf("Error pruning videos: %v", err)
+			}
+			for state, count := range pruned {
+				if count > 0 {
+					log.Printf("Pruned %d %s videos", count, state)
+				}
+			}
+
+			time.Sleep(time.Duration(janitorFrequency) * time.Second)
+		}
+	}()
+}
+
+func envSeconds(name string, fallback int) int {
+	valueStr := os.Getenv(name)
+	if valueStr == "" {
+		return fallback
+	}
+	value, err := strconv.Atoi(valueStr)
+	if err != nil || value < 0 {
+		log.Printf("Invalid %s value: %s, using default %d", name, valueStr, fallback)
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,50 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// terminalSetScript converts a done or fail set from a plain set into a sorted
+// set scored by finish time, using last_attempt_at for videos that finished
+// before finished_at was recorded.
+// KEYS[1] = videos:done or videos:fail
+// ARGV[1] = now, used when a video has no timestamp at all
+// Returns the number of converted members, or -1 if there was nothing to convert.
+var terminalSetScript = redis.NewScript(`
+if redis.call('TYPE', KEYS[1]).ok ~= 'set' then
+	return -1
+end
+
+local members = redis.call('SMEMBERS', KEYS[1])
+redis.call('DEL', KEYS[1])
+for _, uuid in ipairs(members) do
+	local metaKey = 'videos:meta:' .. uuid
+	local finishedAt = redis.call('HGET', metaKey, 'last_attempt_at') or ARGV[1]
+	redis.call('ZADD', KEYS[1], finishedAt, uuid)
+	if redis.call('EXISTS', metaKey) == 1 then
+		redis.call('HSET', metaKey, 'finished_at', finishedAt)
+	end
+end
+return #members
+`)
+
+// Run brings the videos:* keys written by older server versions up to date.
+// Every migration is idempotent, so Run is safe to call on every start.
+func Run(ctx context.Context, rdb *redis.Client) error {
+	for _, key := range []string{"videos:done", "videos:fail"} {
+		converted, err := terminalSetScript.Run(ctx, rdb, []string{key}, time.Now().Unix()).Int()
+		if err != nil {
+			return fmt.Errorf("failed to migrate %s: %v", key, err)
+		}
+		if converted >= 0 {
+			log.Printf("Migrated %s to a sorted set (%d videos)", key, converted)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package migrations
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRunConvertsTerminalSets(t *testing.T) {
+	ctx := context.Background()
+	m := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	t.Cleanup(func() {
+		_ = rdb.Close()
+	})
+
+	// The baseline kept done and failed videos in plain sets
+	rdb.SAdd(ctx, "videos:done", "done1", "orphan")
+	rdb.SAdd(ctx, "videos:fail", "fail1")
+	rdb.HSet(ctx, "videos:meta:done1", "video_id", "v1", "last_attempt_at", 1000)
+	rdb.HSet(ctx, "videos:meta:fail1", "video_id", "v2", "last_attempt_at", 2000)
+
+	if err := Run(ctx, rdb); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	for _, key := range []string{"videos:done", "videos:fail"} {
+		if keyType := rdb.Type(ctx, key).Val(); keyType != "zset" {
+			t.Fatalf("%s is a %s, want a zset", key, keyType)
+		}
+	}
+	if score := rdb.ZScore(ctx, "videos:done", "done1").Val(); score != 1000 {
+		t.Fatalf("done1 finished at %v, want its last attempt 1000", score)
+	}
+	if score := rdb.ZScore(ctx, "videos:fail", "fail1").Val(); score != 2000 {
+		t.Fatalf("fail1 finished at %v, want its last attempt 2000", score)
+	}
+	if finishedAt := rdb.HGet(ctx, "videos:meta:done1", "finished_at").Val(); finishedAt != "1000" {
+		t.Fatalf("done1 finished_at = %q, want 1000", finishedAt)
+	}
+	// A video without metadata keeps its place but gets no metadata hash
+	if rdb.ZScore(ctx, "videos:done", "orphan").Val() == 0 {
+		t.Fatalf("orphan was dropped from videos:done")
+	}
+	if rdb.Exists(ctx, "videos:meta:orphan").Val() != 0 {
+		t.Fatalf("metadata was created for orphan")
+	}
+
+	// A second run finds nothing left to convert
+	before := m.Dump()
+	if err := Run(ctx, rdb); err != nil {
+		t.Fatalf("second Run: %v", err)
+	}
+	if after := m.Dump(); after != before {
+		t.Fatalf("second Run changed the keys from\n%s\nto\n%s", before, after)
+	}
+}
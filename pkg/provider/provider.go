@@ -0,0 +1,262 @@
+package provider
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// DefaultProviders is used when SOURCE_PROVIDERS is not set
+const DefaultProviders = "youtube"
+
+// Media is a URL accepted by one of the providers
+type Media struct {
+	Provider string
+	// URL is the cleaned URL handed to the worker
+	URL string
+	// ID identifies the media across the URL variants of its provider and is
+	// used for duplicate detection
+	ID string
+	// Playlist is set when the URL stands for a list of media, which a worker
+	// expands into one job per entry
+	Playlist bool
+}
+
+// Provider normalizes and validates the URLs of one site that yt-dlp supports
+type Provider struct {
+	// Name is used in SOURCE_PROVIDERS and recorded on every job
+	Name string
+	// Title is the name shown in error messages
+	Title string
+	// Domains are matched together with all their subdomains
+	Domains []string
+	// Normalize cleans a URL on one of the domains and extracts its media id.
+	// Errors complete the sentence "<Title> URL ...".
+	Normalize func(u *url.URL) (*Media, error)
+}
+
+func (p Provider) matches(host string) bool {
+	for _, domain := range p.Domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Builtin lists every provider the server knows, in the order they are tried
+var Builtin = []Provider{YouTube, SoundCloud, Bandcamp, Vimeo, Mixcloud}
+
+// pathSegments splits a URL path into its non-empty segments
+func pathSegments(path string) []string {
+	var segments []string
+	for _, segment := range strings.Split(path, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
+
+var youTubeIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// YouTube accepts single videos and whole playlists. A link to a video in a
+// playlist is cleaned down to just the video.
+var YouTube = Provider{
+	Name:    "youtube",
+	Title:   "YouTube",
+	Domains: []string{"youtube.com", "youtu.be"},
+	Normalize: func(u *url.URL) (*Media, error) {
+		// Handle youtu.be short URLs
+		if strings.HasSuffix(strings.ToLower(u.Hostname()), "youtu.be") {
+			videoID := strings.TrimPrefix(u.Path, "/")
+			if !youTubeIDPattern.MatchString(videoID) {
+				return nil, fmt.Errorf("has no video id")
+			}
+			return &Media{URL: fmt.Sprintf("https://www.youtube.com/watch?v=%s", videoID), ID: videoID}, nil
+		}
+
+		queryParams := u.Query()
+		videoID := queryParams.Get("v")
+		listID := queryParams.Get("list")
+
+		// A playlist without a specific video is expanded, indexed under its
+		// playlist id so the same playlist is only expanded once
+		if videoID == "" && listID != "" {
+			return &Media{
+				URL:      fmt.Sprintf("https://www.youtube.com/playlist?list=%s", url.QueryEscape(listID)),
+				ID:       "list:" + listID,
+				Playlist: true,
+			}, nil
+		}
+
+		if strings.Contains(u.Path, "/playlist") {
+			return nil, fmt.Errorf("is a playlist link without a list parameter")
+		}
+
+		if !youTubeIDPattern.MatchString(videoID) {
+			return nil, fmt.Errorf("has no video id")
+		}
+
+		// Return clean video URL without playlist parameters
+		return &Media{URL: fmt.Sprintf("https://www.youtube.com/watch?v=%s", videoID), ID: videoID}, nil
+	},
+}
+
+// SoundCloud accepts track pages, soundcloud.com/<user>/<track>
+var SoundCloud = Provider{
+	Name:    "soundcloud",
+	Title:   "SoundCloud",
+	Domains: []string{"soundcloud.com"},
+	Normalize: func(u *url.URL) (*Media, error) {
+		if strings.ToLower(u.Hostname()) == "on.soundcloud.com" {
+			return nil, fmt.Errorf("is a short link, use the track page instead")
+		}
+		segments := pathSegments(u.Path)
+		if len(segments) != 2 || segments[1] == "sets" {
+			return nil, fmt.Errorf("is not a track page")
+		}
+		id := strings.ToLower(segments[0] + "/" + segments[1])
+		return &Media{URL: "https://soundcloud.com/" + id, ID: id}, nil
+	},
+}
+
+// Bandcamp accepts track pages, <artist>.bandcamp.com/track/<track>
+var Bandcamp = Provider{
+	Name:    "bandcamp",
+	Title:   "Bandcamp",
+	Domains: []string{"bandcamp.com"},
+	Normalize: func(u *url.URL) (*Media, error) {
+		artist, found := strings.CutSuffix(strings.ToLower(u.Hostname()), ".bandcamp.com")
+		segments := pathSegments(u.Path)
+		if !found || artist == "www" || len(segments) != 2 || segments[0] != "track" {
+			return nil, fmt.Errorf("is not a track page")
+		}
+		id := artist + "/" + strings.ToLower(segments[1])
+		return &Media{URL: fmt.Sprintf("https://%s.bandcamp.com/track/%s", artist, segments[1]), ID: id}, nil
+	},
+}
+
+var vimeoIDPattern = regexp.MustCompile(`^[0-9]+$`)
+
+// Vimeo accepts video pages and player links, which all end in the numeric video id
+var Vimeo = Provider{
+	Name:    "vimeo",
+	Title:   "Vimeo",
+	Domains: []string{"vimeo.com"},
+	Normalize: func(u *url.URL) (*Media, error) {
+		segments := pathSegments(u.Path)
+		if len(segments) == 0 || !vimeoIDPattern.MatchString(segments[len(segments)-1]) {
+			return nil, fmt.Errorf("has no video id")
+		}
+		id := segments[len(segments)-1]
+		return &Media{URL: "https://vimeo.com/" + id, ID: id}, nil
+	},
+}
+
+// Mixcloud accepts show pages, mixcloud.com/<user>/<show>
+var Mixcloud = Provider{
+	Name:    "mixcloud",
+	Title:   "Mixcloud",
+	Domains: []string{"mixcloud.com"},
+	Normalize: func(u *url.URL) (*Media, error) {
+		segments := pathSegments(u.Path)
+		if len(segments) != 2 {
+			return nil, fmt.Errorf("is not a show page")
+		}
+		id := strings.ToLower(segments[0] + "/" + segments[1])
+		return &Media{URL: "https://www.mixcloud.com/" + id + "/", ID: id}, nil
+	},
+}
+
+// Registry holds the providers an operator enabled
+type Registry struct {
+	providers []Provider
+}
+
+// New enables the named builtin providers
+func New(names []string) (*Registry, error) {
+	registry := &Registry{}
+	for _, name := range names {
+		found := false
+		for _, p := range Builtin {
+			if p.Name == name {
+				registry.providers = append(registry.providers, p)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown source provider %q", name)
+		}
+	}
+	return registry, nil
+}
+
+// FromEnv enables the comma separated providers in SOURCE_PROVIDERS, falling
+// back to DefaultProviders if it is unset or invalid
+func FromEnv() *Registry {
+	namesStr := os.Getenv("SOURCE_PROVIDERS")
+	if namesStr == "" {
+		namesStr = DefaultProviders
+	}
+
+	var names []string
+	for _, name := range strings.Split(namesStr, ",") {
+		if name = strings.TrimSpace(strings.ToLower(name)); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	registry, err := New(names)
+	if err != nil || len(registry.providers) == 0 {
+		log.Printf("Invalid SOURCE_PROVIDERS value: %s, using default %s", namesStr, DefaultProviders)
+		registry, _ = New([]string{DefaultProviders})
+	}
+	return registry
+}
+
+// Names returns the names of the enabled providers
+func (r *Registry) Names() []string {
+	names := make([]string, len(r.providers))
+	for i, p := range r.providers {
+		names[i] = p.Name
+	}
+	return names
+}
+
+// Resolve finds the enabled provider for a URL and normalizes it. Media ids of
+// providers other than YouTube are prefixed with the provider name, YouTube ids
+// stay bare so videos indexed before providers existed are still detected as
+// duplicates.
+func (r *Registry) Resolve(rawURL string) (*Media, error) {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil || parsedURL.Host == "" {
+		return nil, fmt.Errorf("malformed URL")
+	}
+	host := strings.ToLower(parsedURL.Hostname())
+
+	for _, p := range r.providers {
+		if !p.matches(host) {
+			continue
+		}
+		media, err := p.Normalize(parsedURL)
+		if err != nil {
+			return nil, fmt.Errorf("%s URL %v", p.Title, err)
+		}
+		media.Provider = p.Name
+		if p.Name != YouTube.Name {
+			media.ID = p.Name + ":" + media.ID
+		}
+		return media, nil
+	}
+
+	titles := make([]string, len(r.providers))
+	for i, p := range r.providers {
+		titles[i] = p.Title
+	}
+	return nil, fmt.Errorf("only %s URLs are allowed", strings.Join(titles, ", "))
+}
@@ -0,0 +1,116 @@
+package provider
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	registry, err := New([]string{"youtube", "soundcloud", "bandcamp", "vimeo", "mixcloud"})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	tests := []struct {
+		rawURL string
+		// want is nil when the URL is rejected
+		want *Media
+	}{
+		// YouTube ids stay bare, playlists are indexed under list:<id>
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ", &Media{Provider: "youtube", URL: "https://www.youtube.com/watch?v=dQw4w9WgXcQ", ID: "dQw4w9WgXcQ"}},
+		{"https://youtu.be/dQw4w9WgXcQ?t=42", &Media{Provider: "youtube", URL: "https://www.youtube.com/watch?v=dQw4w9WgXcQ", ID: "dQw4w9WgXcQ"}},
+		{"https://m.youtube.com/watch?v=dQw4w9WgXcQ&list=PLabc&index=3", &Media{Provider: "youtube", URL: "https://www.youtube.com/watch?v=dQw4w9WgXcQ", ID: "dQw4w9WgXcQ"}},
+		{"https://www.youtube.com/playlist?list=PLabc_123", &Media{Provider: "youtube", URL: "https://www.youtube.com/playlist?list=PLabc_123", ID: "list:PLabc_123", Playlist: true}},
+		{"https://www.youtube.com/watch?list=PLabc", &Media{Provider: "youtube", URL: "https://www.youtube.com/playlist?list=PLabc", ID: "list:PLabc", Playlist: true}},
+		{"https://www.youtube.com/playlist", nil},
+		{"https://www.youtube.com/watch?v=", nil},
+		{"https://www.youtube.com/watch?v=bad%20id", nil},
+		{"https://youtu.be/", nil},
+
+		// SoundCloud takes track pages only
+		{"https://soundcloud.com/Artist/Track-Name?in=x", &Media{Provider: "soundcloud", URL: "https://soundcloud.com/artist/track-name", ID: "soundcloud:artist/track-name"}},
+		{"https://m.soundcloud.com/artist/track/", &Media{Provider: "soundcloud", URL: "https://soundcloud.com/artist/track", ID: "soundcloud:artist/track"}},
+		{"https://on.soundcloud.com/abc", nil},
+		{"https://soundcloud.com/artist", nil},
+		{"https://soundcloud.com/artist/sets", nil},
+		{"https://soundcloud.com/artist/sets/album", nil},
+
+		// Bandcamp takes track pages on an artist subdomain
+		{"https://artist.bandcamp.com/track/Song", &Media{Provider: "bandcamp", URL: "https://artist.bandcamp.com/track/Song", ID: "bandcamp:artist/song"}},
+		{"https://Artist.Bandcamp.com/track/song?from=x", &Media{Provider: "bandcamp", URL: "https://artist.bandcamp.com/track/song", ID: "bandcamp:artist/song"}},
+		{"https://artist.bandcamp.com/album/record", nil},
+		{"https://bandcamp.com/track/song", nil},
+		{"https://www.bandcamp.com/track/song", nil},
+
+		// Vimeo takes any path ending in the numeric video id
+		{"https://vimeo.com/123456", &Media{Provider: "vimeo", URL: "https://vimeo.com/123456", ID: "vimeo:123456"}},
+		{"https://player.vimeo.com/video/123456?h=abc", &Media{Provider: "vimeo", URL: "https://vimeo.com/123456", ID: "vimeo:123456"}},
+		{"https://vimeo.com/channels/staffpicks/123456", &Media{Provider: "vimeo", URL: "https://vimeo.com/123456", ID: "vimeo:123456"}},
+		{"https://vimeo.com/", nil},
+		{"https://vimeo.com/user/about", nil},
+
+		// Mixcloud takes show pages
+		{"https://www.mixcloud.com/User/Show-Name/", &Media{Provider: "mixcloud", URL: "https://www.mixcloud.com/user/show-name/", ID: "mixcloud:user/show-name"}},
+		{"https://mixcloud.com/user/show", &Media{Provider: "mixcloud", URL: "https://www.mixcloud.com/user/show/", ID: "mixcloud:user/show"}},
+		{"https://www.mixcloud.com/user/", nil},
+		{"https://www.mixcloud.com/user/show/extra/", nil},
+
+		// Other sites and malformed URLs
+		{"https://example.com/watch?v=dQw4w9WgXcQ", nil},
+		{"https://notyoutube.com/watch?v=dQw4w9WgXcQ", nil},
+		{"youtube.com/watch?v=dQw4w9WgXcQ", nil},
+		{"://", nil},
+	}
+	for _, test := range tests {
+		media, err := registry.Resolve(test.rawURL)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("Resolve(%q) = %+v, want an error", test.rawURL, media)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Resolve(%q): %v", test.rawURL, err)
+			continue
+		}
+		if *media != *test.want {
+			t.Errorf("Resolve(%q) = %+v, want %+v", test.rawURL, media, test.want)
+		}
+	}
+}
+
+func TestResolveOnlyEnabledProviders(t *testing.T) {
+	registry, err := New([]string{"vimeo"})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	_, err = registry.Resolve("https://www.youtube.com/watch?v=dQw4w9WgXcQ")
+	if err == nil || err.Error() != "only Vimeo URLs are allowed" {
+		t.Fatalf("Resolve of a disabled provider = %v", err)
+	}
+	_, err = registry.Resolve("https://vimeo.com/user/about")
+	if err == nil || err.Error() != "Vimeo URL has no video id" {
+		t.Fatalf("Resolve of a rejected URL = %v", err)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	tests := []struct {
+		env  string
+		want []string
+	}{
+		{"", []string{"youtube"}},
+		{"youtube", []string{"youtube"}},
+		{" SoundCloud , vimeo,,mixcloud ", []string{"soundcloud", "vimeo", "mixcloud"}},
+		{"bandcamp,youtube", []string{"bandcamp", "youtube"}},
+		// Unknown or empty lists fall back to the default
+		{"youtube,dailymotion", []string{"youtube"}},
+		{" , ", []string{"youtube"}},
+	}
+	for _, test := range tests {
+		t.Setenv("SOURCE_PROVIDERS", test.env)
+		if got := FromEnv().Names(); !slices.Equal(got, test.want) {
+			t.Errorf("SOURCE_PROVIDERS=%q enables %v, want %v", test.env, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// burstWindow is the fixed window the burst limit counts requests in
+const burstWindow = time.Minute
+
+// Limits caps the submissions of one token or client IP. Burst counts requests
+// per minute, the quotas count videos per UTC day and ISO week. 0 disables a limit.
+type Limits struct {
+	Burst  int
+	Daily  int
+	Weekly int
+}
+
+// LimitsFromEnv reads the limits from RATE_LIMIT_BURST, RATE_LIMIT_DAILY and
+// RATE_LIMIT_WEEKLY. Only the burst limit is on by default.
+func LimitsFromEnv() Limits {
+	return Limits{
+		Burst:  envInt("RATE_LIMIT_BURST", 60),
+		Daily:  envInt("RATE_LIMIT_DAILY", 0),
+		Weekly: envInt("RATE_LIMIT_WEEKLY", 0),
+	}
+}
+
+// Names of the limits, as returned by Take
+const (
+	LimitBurst  = "burst"
+	LimitDaily  = "daily"
+	LimitWeekly = "weekly"
+)
+
+// takeScript counts a request against every limit, or none of them if any
+// would be exceeded. Counters expire at the end of their window.
+// KEYS[1..3] = burst, daily and weekly counter
+// ARGV[1] = cost of the request for the burst limit, ARGV[2] = cost for the quotas,
+// ARGV[3..5] = limit of each counter (0 = none), ARGV[6..8] = window end of each counter
+// Returns 0 if the request was counted, otherwise the 1-based index of the exceeded limit.
+var takeScript = redis.NewScript(`
+local costs = {tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[2])}
+for i = 1, 3 do
+	local limit = tonumber(ARGV[2 + i])
+	if limit > 0 and tonumber(redis.call('GET', KEYS[i]) or '0') + costs[i] > limit then
+		return i
+	end
+end
+for i = 1, 3 do
+	if tonumber(ARGV[2 + i]) > 0 then
+		redis.call('INCRBY', KEYS[i], costs[i])
+		redis.call('EXPIREAT', KEYS[i], ARGV[5 + i])
+	end
+end
+return 0
+`)
+
+// takeUpToScript counts as many videos against the quotas as they still allow
+// KEYS[1..2] = daily and weekly counter
+// ARGV[1] = number of videos, ARGV[2..3] = limit of each counter (0 = none),
+// ARGV[4..5] = window end of each counter
+// Returns the number of videos counted.
+var takeUpToScript = redis.NewScript(`
+local granted = tonumber(ARGV[1])
+for i = 1, 2 do
+	local limit = tonumber(ARGV[1 + i])
+	if limit > 0 then
+		local left = limit - tonumber(redis.call('GET', KEYS[i]) or '0')
+		granted = math.max(math.min(granted, left), 0)
+	end
+end
+for i = 1, 2 do
+	if tonumber(ARGV[1 + i]) > 0 and granted > 0 then
+		redis.call('INCRBY', KEYS[i], granted)
+		redis.call('EXPIREAT', KEYS[i], ARGV[3 + i])
+	end
+end
+return granted
+`)
+
+// Limiter enforces Limits with Redis counters, so they hold across server replicas
+type Limiter struct {
+	rdb *redis.Client
+	// Limits apply to every key that is not given its own
+	Limits Limits
+}
+
+func New(rdb *redis.Client, limits Limits) *Limiter {
+	return &Limiter{rdb: rdb, Limits: limits}
+}
+
+// windowEnds returns the end of the burst, day and week windows around now
+func windowEnds(now time.Time) [3]time.Time {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	// ISO weeks start on Monday
+	weekday := (int(day.Weekday()) + 6) % 7
+	return [3]time.Time{
+		now.Truncate(burstWindow).Add(burstWindow),
+		day.AddDate(0, 0, 1),
+		day.AddDate(0, 0, 7-weekday),
+	}
+}
+
+// counterKeys returns the burst, daily and weekly counter of a key
+func counterKeys(key string, now time.Time, ends [3]time.Time) []string {
+	year, week := now.UTC().ISOWeek()
+	return []string{
+		fmt.Sprintf("ratelimit:%s:burst:%d", key, ends[0].Unix()),
+		fmt.Sprintf("ratelimit:%s:day:%s", key, now.UTC().Format("2006-01-02")),
+		fmt.Sprintf("ratelimit:%s:week:%d-%02d", key, year, week),
+	}
+}
+
+// Take counts one request submitting the given number of videos against the
+// limits of a key. If a limit is exceeded nothing is counted, and its name and
+// how long until its window ends are returned.
+func (l *Limiter) Take(ctx context.Context, key string, videos int, limits Limits, now time.Time) (string, time.Duration, error) {
+	ends := windowEnds(now)
+	keys := counterKeys(key, now, ends)
+
+	exceeded, err := takeScript.Run(ctx, l.rdb, keys,
+		1, videos,
+		limits.Burst, limits.Daily, limits.Weekly,
+		ends[0].Unix(), ends[1].Unix(), ends[2].Unix(),
+	).Int()
+	if err != nil || exceeded == 0 {
+		return "", 0, err
+	}
+	return []string{LimitBurst, LimitDaily, LimitWeekly}[exceeded-1], ends[exceeded-1].Sub(now), nil
+}
+
+// TakeUpTo counts as many of the given number of videos against the daily and
+// weekly quotas of a key as they still allow, and returns that number. It is
+// meant for videos the server adds on behalf of a submitter, so the burst
+// limit, which counts requests, does not apply.
+func (l *Limiter) TakeUpTo(ctx context.Context, key string, videos int, limits Limits, now time.Time) (int, error) {
+	ends := windowEnds(now)
+	keys := counterKeys(key, now, ends)
+	return takeUpToScript.Run(ctx, l.rdb, keys[1:],
+		videos, limits.Daily, limits.Weekly, ends[1].Unix(), ends[2].Unix(),
+	).Int()
+}
+
+// Refund gives videos counted by Take or TakeUpTo back to the quotas of a key
+func (l *Limiter) Refund(ctx context.Context, key string, videos int, limits Limits, now time.Time) error {
+	keys := counterKeys(key, now, windowEnds(now))
+	_, err := l.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if limits.Daily > 0 {
+			pipe.DecrBy(ctx, keys[1], int64(videos))
+		}
+		if limits.Weekly > 0 {
+			pipe.DecrBy(ctx, keys[2], int64(videos))
+		}
+		return nil
+	})
+	return err
+}
+
+func envInt(name string, fallback int) int {
+	valueStr := os.Getenv(name)
+	if valueStr == "" {
+		return fallback
+	}
+	value, err := strconv.Atoi(valueStr)
+	if err != nil || value < 0 {
+		log.Printf("Invalid %s value: %s, using default %d", name, valueStr, fallback)
+		return fallback
+	}
+	return value
+}
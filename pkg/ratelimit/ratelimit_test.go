@@ -0,0 +1,47 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestTakeUpTo(t *testing.T) {
+	ctx := context.Background()
+	m := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	t.Cleanup(func() {
+		_ = rdb.Close()
+	})
+	limiter := New(rdb, Limits{})
+	limits := Limits{Burst: 1, Daily: 10, Weekly: 25}
+	now := time.Date(2026, 10, 12, 12, 0, 0, 0, time.UTC)
+	// Counters expire at the end of their window, as seen by Redis
+	m.SetTime(now)
+
+	if limit, _, err := limiter.Take(ctx, "token:a", 4, limits, now); err != nil || limit != "" {
+		t.Fatalf("Take = %q, %v", limit, err)
+	}
+	// The burst limit does not apply, the daily quota has 6 videos left
+	granted, err := limiter.TakeUpTo(ctx, "token:a", 8, limits, now)
+	if err != nil || granted != 6 {
+		t.Fatalf("TakeUpTo = %d, %v, want 6", granted, err)
+	}
+	if granted, err := limiter.TakeUpTo(ctx, "token:a", 8, limits, now); err != nil || granted != 0 {
+		t.Fatalf("TakeUpTo with the quota used up = %d, %v, want 0", granted, err)
+	}
+
+	if err := limiter.Refund(ctx, "token:a", 3, limits, now); err != nil {
+		t.Fatalf("Refund: %v", err)
+	}
+	// 18 videos are left of the weekly quota, 10 of them fit on the next day
+	if granted, err := limiter.TakeUpTo(ctx, "token:a", 20, limits, now.AddDate(0, 0, 1)); err != nil || granted != 10 {
+		t.Fatalf("TakeUpTo the next day = %d, %v, want 10", granted, err)
+	}
+	if granted, err := limiter.TakeUpTo(ctx, "token:a", 20, limits, now.AddDate(0, 0, 2)); err != nil || granted != 8 {
+		t.Fatalf("TakeUpTo the rest of the week = %d, %v, want 8", granted, err)
+	}
+}
@@ -0,0 +1,43 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"firecast/pkg/store"
+
+	"github.com/joho/godotenv"
+)
+
+// Scheduler periodically queues the scheduled videos that became due
+func Scheduler(ctx context.Context, jobStore store.Store) {
+
+	err := godotenv.Load()
+	if err != nil {
+		fmt.Println("Error loading .env file - using environment variables")
+	}
+
+	schedulerFrequencyStr := os.Getenv("SCHEDULER_INTERVAL")
+	if schedulerFrequencyStr == "" {
+		schedulerFrequencyStr = "5"
+	}
+	schedulerFrequency, err := strconv.Atoi(schedulerFrequencyStr)
+	if err != nil {
+		log.Printf("Invalid SCHEDULER_INTERVAL value: %s, using default 5", schedulerFrequencyStr)
+		schedulerFrequency = 5
+	}
+
+	go func() {
+		for {
+			if _, err := jobStore.Promote(ctx, time.Now()); err != nil {
+				log.Printf("Error promoting scheduled videos: %v", err)
+			}
+
+			time.Sleep(time.Duration(schedulerFrequency) * time.Second)
+		}
+	}()
+}
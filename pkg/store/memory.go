@@ -0,0 +1,705 @@
+package store
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"firecast/pkg/events"
+	"firecast/pkg/structs"
+)
+
+// Memory is a Store that keeps jobs in the process, for tests and single-node
+// use. Its jobs are lost when the process exits. Events are published once the
+// transition that recorded them is done, and scheduled jobs are also promoted
+// when a worker claims, so it works without the scheduler.
+type Memory struct {
+	config  Config
+	publish events.Publisher
+
+	mu        sync.Mutex
+	meta      map[string]map[string]string
+	events    map[string][]structs.VideoEvent
+	index     map[string]string
+	queues    map[string][]string
+	scheduled map[string]int64
+	wip       map[string]int64
+	done      map[string]int64
+	fail      map[string]int64
+	janitor   structs.JanitorStatus
+	// outbox holds the events to publish once mu is released
+	outbox []structs.VideoEvent
+	// wake is closed and replaced whenever a job is queued, waking every Wait
+	wake chan struct{}
+}
+
+// NewMemory returns an empty in-memory store. publish may be nil if nothing
+// subscribes to events.
+func NewMemory(config Config, publish events.Publisher) *Memory {
+	return &Memory{
+		config:    config,
+		publish:   publish,
+		meta:      map[string]map[string]string{},
+		events:    map[string][]structs.VideoEvent{},
+		index:     map[string]string{},
+		queues:    map[string][]string{},
+		scheduled: map[string]int64{},
+		wip:       map[string]int64{},
+		done:      map[string]int64{},
+		fail:      map[string]int64{},
+		wake:      make(chan struct{}),
+	}
+}
+
+// push queues a job behind the others of its priority. The caller holds mu.
+func (s *Memory) push(uuid string) {
+	priority := s.meta[uuid]["priority"]
+	s.queues[priority] = append(s.queues[priority], uuid)
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
+
+// unlock releases mu and then publishes the events of the transition
+func (s *Memory) unlock(ctx context.Context) {
+	outbox := s.outbox
+	s.outbox = nil
+	s.mu.Unlock()
+
+	if s.publish == nil {
+		return
+	}
+	for _, event := range outbox {
+		if err := s.publish(ctx, event); err != nil {
+			log.Printf("Error publishing %s event of %s: %v", event.Type, event.Uuid, err)
+		}
+	}
+}
+
+// appendEvent records an event and publishes it. The caller holds mu.
+func (s *Memory) appendEvent(uuid string, event structs.VideoEvent) {
+	s.events[uuid] = append(s.events[uuid], event)
+	s.publishEvent(uuid, event)
+}
+
+// publishEvent updates the progress of the expand job that added the job, if
+// any, and queues the event for publishing. The caller holds mu.
+func (s *Memory) publishEvent(uuid string, event structs.VideoEvent) {
+	s.updateParent(uuid, event)
+	event.Uuid = uuid
+	event.PlaylistId, _ = strconv.Atoi(s.meta[uuid]["playlist_id"])
+	s.outbox = append(s.outbox, event)
+}
+
+// updateParent applies an event of a child job to the progress counters of
+// its expand job. The caller holds mu.
+func (s *Memory) updateParent(uuid string, event structs.VideoEvent) {
+	parent, ok := s.meta[s.meta[uuid]["parent"]]
+	if !ok {
+		return
+	}
+	if field, delta := progressField(event); field != "" {
+		count, _ := strconv.Atoi(parent[field])
+		parent[field] = strconv.Itoa(count + delta)
+	}
+}
+
+// drop deletes a job with everything that refers to it. The caller holds mu.
+func (s *Memory) drop(uuid string) {
+	meta := s.meta[uuid]
+	indexField := meta["video_id"] + ":" + meta["playlist_id"]
+	if s.index[indexField] == uuid {
+		delete(s.index, indexField)
+	}
+	priority := meta["priority"]
+	s.queues[priority] = slices.DeleteFunc(s.queues[priority], func(queued string) bool {
+		return queued == uuid
+	})
+	delete(s.scheduled, uuid)
+	delete(s.wip, uuid)
+	delete(s.meta, uuid)
+	delete(s.events, uuid)
+}
+
+// remove drops a cancelled job. The caller holds mu.
+func (s *Memory) remove(uuid string, now int64) {
+	s.publishEvent(uuid, structs.VideoEvent{Type: structs.EventCancelled, At: now})
+	s.drop(uuid)
+}
+
+// finishable reports why an in-progress job cannot finish, or "" if it can.
+// A cancelled job is dropped. The caller holds mu.
+func (s *Memory) finishable(uuid, token string, now int64) string {
+	meta, ok := s.meta[uuid]
+	if !ok || meta["attempt_token"] != token {
+		return "stale"
+	}
+	if _, ok := meta["cancelled_at"]; ok {
+		s.remove(uuid, now)
+		return "cancelled"
+	}
+	if _, ok := s.done[uuid]; ok {
+		return "done"
+	}
+	if _, ok := s.fail[uuid]; ok {
+		return "fail"
+	}
+	if _, ok := s.wip[uuid]; !ok {
+		return "not_wip"
+	}
+	return ""
+}
+
+// retryLater takes a job out of the wip state and queues it, or schedules it
+// if its next attempt is in the future. The caller holds mu.
+func (s *Memory) retryLater(uuid string, now, nextAttemptAt int64) string {
+	meta := s.meta[uuid]
+	delete(s.wip, uuid)
+	delete(meta, "attempt_token")
+	meta["last_attempt_at"] = strconv.FormatInt(now, 10)
+	meta["not_before"] = strconv.FormatInt(nextAttemptAt, 10)
+	if nextAttemptAt > now {
+		s.scheduled[uuid] = nextAttemptAt
+		return "scheduled"
+	}
+	s.push(uuid)
+	return "queue"
+}
+
+// dueBy returns the jobs of a state whose score is at or below now, ordered by
+// score and then uuid like a Redis sorted set
+func dueBy(set map[string]int64, now int64) []string {
+	var due []string
+	for uuid, score := range set {
+		if score <= now {
+			due = append(due, uuid)
+		}
+	}
+	slices.SortFunc(due, func(a, b string) int {
+		return cmp.Or(cmp.Compare(set[a], set[b]), cmp.Compare(a, b))
+	})
+	return due
+}
+
+// enqueue stores one job. The caller holds mu.
+func (s *Memory) enqueue(job *Job, now int64) EnqueueResult {
+	if existing, ok := s.index[job.IndexField]; ok && !job.Force {
+		if _, ok := s.meta[existing]; ok {
+			return EnqueueResult{Uuid: existing, Duplicate: true}
+		}
+	}
+
+	meta := make(map[string]string, len(job.Meta)/2)
+	for j := 0; j+1 < len(job.Meta); j += 2 {
+		meta[fmt.Sprint(job.Meta[j])] = fmt.Sprint(job.Meta[j+1])
+	}
+	s.meta[job.Uuid] = meta
+	s.index[job.IndexField] = job.Uuid
+
+	event := structs.VideoEvent{Type: structs.EventAdded, At: now, Priority: meta["priority"]}
+	if job.NotBefore > 0 {
+		s.scheduled[job.Uuid] = job.NotBefore
+		event.State = structs.StateScheduled
+		event.NotBefore = job.NotBefore
+	} else {
+		s.push(job.Uuid)
+		event.State = structs.StateQueued
+	}
+	s.appendEvent(job.Uuid, event)
+	return EnqueueResult{Uuid: job.Uuid}
+}
+
+func (s *Memory) Enqueue(ctx context.Context, jobs []*Job, now time.Time) ([]EnqueueResult, error) {
+	s.mu.Lock()
+	defer s.unlock(ctx)
+
+	results := make([]EnqueueResult, len(jobs))
+	for i, job := range jobs {
+		results[i] = s.enqueue(job, now.Unix())
+	}
+	return results, nil
+}
+
+// promote queues the due scheduled jobs in due order, as the scheduler does.
+// The caller holds mu.
+func (s *Memory) promote(now int64) int {
+	due := dueBy(s.scheduled, now)
+	for _, uuid := range due {
+		delete(s.scheduled, uuid)
+		s.push(uuid)
+		s.appendEvent(uuid, structs.VideoEvent{Type: structs.EventPromoted, At: now, State: structs.StateQueued})
+	}
+	return len(due)
+}
+
+func (s *Memory) Claim(ctx context.Context, token, worker string, now time.Time) (*Claim, error) {
+	s.mu.Lock()
+	defer s.unlock(ctx)
+
+	s.promote(now.Unix())
+
+	var uuid string
+	for _, priority := range structs.Priorities {
+		if queue := s.queues[priority]; len(queue) > 0 {
+			uuid = queue[0]
+			s.queues[priority] = queue[1:]
+			break
+		}
+	}
+	if uuid == "" {
+		return nil, nil
+	}
+
+	claim := &Claim{Uuid: uuid, LeaseExpiresAt: now.Add(s.config.LeaseDuration).Unix()}
+	meta, ok := s.meta[uuid]
+	if !ok {
+		s.fail[uuid] = now.Unix()
+		return claim, nil
+	}
+
+	retries, _ := strconv.Atoi(meta["retries"])
+	meta["retries"] = strconv.Itoa(retries + 1)
+	meta["attempt_token"] = token
+	meta["claimed_at"] = strconv.FormatInt(now.Unix(), 10)
+	meta["worker"] = worker
+	s.wip[uuid] = claim.LeaseExpiresAt
+	s.appendEvent(uuid, structs.VideoEvent{
+		Type:    structs.EventClaimed,
+		At:      now.Unix(),
+		State:   structs.StateWip,
+		Worker:  worker,
+		Attempt: retries + 1,
+	})
+
+	claim.Meta = make(map[string]string, len(meta))
+	for field, value := range meta {
+		claim.Meta[field] = value
+	}
+	return claim, nil
+}
+
+// Wait also returns when the next scheduled job becomes due, since there may be
+// no scheduler to queue it
+func (s *Memory) Wait(ctx context.Context, timeout time.Duration) error {
+	s.mu.Lock()
+	wake := s.wake
+	for _, notBefore := range s.scheduled {
+		timeout = min(timeout, time.Until(time.Unix(notBefore, 0)))
+	}
+	s.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-wake:
+	case <-timer.C:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (s *Memory) Heartbeat(ctx context.Context, uuid, token, stage string, now time.Time) (string, int64, error) {
+	s.mu.Lock()
+	defer s.unlock(ctx)
+
+	leaseDeadline := now.Add(s.config.LeaseDuration).Unix()
+	meta, ok := s.meta[uuid]
+	if !ok || meta["attempt_token"] != token {
+		return "stale", leaseDeadline, nil
+	}
+	if _, ok := meta["cancelled_at"]; ok {
+		return "cancelled", leaseDeadline, nil
+	}
+	if _, ok := s.wip[uuid]; !ok {
+		return "not_wip", leaseDeadline, nil
+	}
+	s.wip[uuid] = leaseDeadline
+	if stage != "" {
+		s.publishEvent(uuid, structs.VideoEvent{Type: structs.EventProgress, At: now.Unix(), State: structs.StateWip, Stage: stage})
+	}
+	return "ok", leaseDeadline, nil
+}
+
+func (s *Memory) Complete(ctx context.Context, uuid, token string, now time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.unlock(ctx)
+
+	if status := s.finishable(uuid, token, now.Unix()); status != "" {
+		return status, nil
+	}
+	delete(s.wip, uuid)
+	s.done[uuid] = now.Unix()
+	s.meta[uuid]["finished_at"] = strconv.FormatInt(now.Unix(), 10)
+	s.appendEvent(uuid, structs.VideoEvent{Type: structs.EventDone, At: now.Unix(), State: structs.StateDone})
+	return "ok", nil
+}
+
+func (s *Memory) Fail(ctx context.Context, uuid, token string, failure Failure, now time.Time) (string, int64, error) {
+	s.mu.Lock()
+	defer s.unlock(ctx)
+
+	meta := s.meta[uuid]
+	retries, _ := strconv.Atoi(meta["retries"])
+	retry, nextAttemptAt := s.config.retryAt(retries, failure.Class, now)
+	if status := s.finishable(uuid, token, now.Unix()); status != "" {
+		return status, nextAttemptAt, nil
+	}
+
+	meta["last_error"] = failure.Error
+	meta["last_error_stage"] = failure.Stage
+	meta["last_error_class"] = failure.Class
+	meta["last_error_at"] = strconv.FormatInt(now.Unix(), 10)
+	event := structs.VideoEvent{
+		Type:  structs.EventFailed,
+		At:    now.Unix(),
+		Error: failure.Error,
+		Stage: failure.Stage,
+		Class: failure.Class,
+	}
+
+	status := "ok"
+	if retry {
+		event.Type = structs.EventAttemptFailed
+		status = s.retryLater(uuid, now.Unix(), nextAttemptAt)
+	} else {
+		delete(s.wip, uuid)
+		s.fail[uuid] = now.Unix()
+		meta["finished_at"] = strconv.FormatInt(now.Unix(), 10)
+	}
+	event.State, event.NotBefore = stateAfter(status, nextAttemptAt)
+	s.appendEvent(uuid, event)
+	return status, nextAttemptAt, nil
+}
+
+// stateAfter returns the state and due time a job is left in by a failure or
+// recovery that returned the given status
+func stateAfter(status string, nextAttemptAt int64) (string, int64) {
+	switch status {
+	case "queue":
+		return structs.StateQueued, 0
+	case "scheduled":
+		return structs.StateScheduled, nextAttemptAt
+	}
+	return structs.StateFail, 0
+}
+
+func (s *Memory) Recover(ctx context.Context, now time.Time) ([]Recovery, error) {
+	s.mu.Lock()
+	defer s.unlock(ctx)
+
+	var recovered []Recovery
+	for _, uuid := range dueBy(s.wip, now.Unix()) {
+		meta := s.meta[uuid]
+		retries, _ := strconv.Atoi(meta["retries"])
+		nextAttemptAt := s.config.RetryPolicy.NextAttemptAt(now, retries).Unix()
+		recovery := Recovery{Uuid: uuid, NotBefore: nextAttemptAt}
+		switch {
+		case meta["cancelled_at"] != "":
+			s.remove(uuid, now.Unix())
+			recovery.Status = "cancelled"
+		case retries >= s.config.MaxRetries:
+			delete(s.wip, uuid)
+			delete(meta, "attempt_token")
+			s.fail[uuid] = now.Unix()
+			meta["finished_at"] = strconv.FormatInt(now.Unix(), 10)
+			recovery.Status = "fail"
+		default:
+			recovery.Status = s.retryLater(uuid, now.Unix(), nextAttemptAt)
+		}
+		if recovery.Status != "cancelled" {
+			event := structs.VideoEvent{Type: structs.EventTimedOut, At: now.Unix()}
+			event.State, event.NotBefore = stateAfter(recovery.Status, nextAttemptAt)
+			if event.State == structs.StateFail {
+				event.Type, event.Error = structs.EventFailed, leaseExpiredError
+			}
+			s.appendEvent(uuid, event)
+		}
+		recovered = append(recovered, recovery)
+	}
+	return recovered, nil
+}
+
+func (s *Memory) Expand(ctx context.Context, uuid, token string, children []*Job, now time.Time) (string, []EnqueueResult, error) {
+	s.mu.Lock()
+	defer s.unlock(ctx)
+
+	if status := s.finishable(uuid, token, now.Unix()); status != "" {
+		return status, nil, nil
+	}
+
+	results := make([]EnqueueResult, len(children))
+	created, duplicates := 0, 0
+	for i, child := range children {
+		job := *child
+		job.Meta = append(slices.Clip(child.Meta), "parent", uuid)
+		results[i] = s.enqueue(&job, now.Unix())
+		if results[i].Duplicate {
+			duplicates++
+		} else {
+			created++
+		}
+	}
+
+	meta := s.meta[uuid]
+	delete(s.wip, uuid)
+	s.done[uuid] = now.Unix()
+	meta["finished_at"] = strconv.FormatInt(now.Unix(), 10)
+	meta["children_total"] = strconv.Itoa(created)
+	meta["children_duplicate"] = strconv.Itoa(duplicates)
+	meta["children_done"] = "0"
+	meta["children_failed"] = "0"
+	meta["children_cancelled"] = "0"
+	s.appendEvent(uuid, structs.VideoEvent{
+		Type:       structs.EventExpanded,
+		At:         now.Unix(),
+		State:      structs.StateDone,
+		Children:   created,
+		Duplicates: duplicates,
+	})
+	return "ok", results, nil
+}
+
+func (s *Memory) Cancel(ctx context.Context, uuid string, now time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.unlock(ctx)
+
+	meta, ok := s.meta[uuid]
+	if !ok {
+		return "missing", nil
+	}
+	if _, ok := s.wip[uuid]; ok {
+		meta["cancelled_at"] = strconv.FormatInt(now.Unix(), 10)
+		s.appendEvent(uuid, structs.VideoEvent{Type: structs.EventCancelRequested, At: now.Unix(), State: structs.StateWip})
+		return "cancelling", nil
+	}
+	_, done := s.done[uuid]
+	_, failed := s.fail[uuid]
+	if done || failed {
+		return "finished", nil
+	}
+	s.remove(uuid, now.Unix())
+	return "deleted", nil
+}
+
+func (s *Memory) Retry(ctx context.Context, uuid string, resetRetries bool, now time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.unlock(ctx)
+
+	meta, ok := s.meta[uuid]
+	if !ok {
+		return "missing", nil
+	}
+	if _, ok := s.fail[uuid]; !ok {
+		return "not_failed", nil
+	}
+
+	delete(s.fail, uuid)
+	delete(meta, "finished_at")
+	delete(meta, "attempt_token")
+	meta["last_attempt_at"] = strconv.FormatInt(now.Unix(), 10)
+	meta["not_before"] = "0"
+	if resetRetries {
+		meta["retries"] = "0"
+	}
+	s.push(uuid)
+	s.appendEvent(uuid, structs.VideoEvent{Type: structs.EventRetried, At: now.Unix(), State: structs.StateQueued})
+	return "ok", nil
+}
+
+func (s *Memory) Promote(ctx context.Context, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.unlock(ctx)
+
+	return s.promote(now.Unix()), nil
+}
+
+func (s *Memory) Prune(ctx context.Context, cutoffs map[string]int64, now time.Time) (map[string]int, error) {
+	s.mu.Lock()
+	defer s.unlock(ctx)
+
+	pruned := make(map[string]int, len(cutoffs))
+	s.janitor.LastRunAt = now.Unix()
+	for state, set := range map[string]map[string]int64{structs.StateDone: s.done, structs.StateFail: s.fail} {
+		cutoff, ok := cutoffs[state]
+		if !ok {
+			continue
+		}
+		for _, uuid := range dueBy(set, cutoff) {
+			delete(set, uuid)
+			s.drop(uuid)
+			pruned[state]++
+		}
+	}
+	s.janitor.DonePruned += pruned[structs.StateDone]
+	s.janitor.FailPruned += pruned[structs.StateFail]
+	if _, ok := cutoffs[structs.StateDone]; ok {
+		s.janitor.LastDonePruned = pruned[structs.StateDone]
+	}
+	if _, ok := cutoffs[structs.StateFail]; ok {
+		s.janitor.LastFailPruned = pruned[structs.StateFail]
+	}
+	return pruned, nil
+}
+
+// lookup finds a job and where it sits. The caller holds mu.
+func (s *Memory) lookup(uuid string) *Video {
+	meta, ok := s.meta[uuid]
+	if !ok {
+		return nil
+	}
+	video := &Video{Uuid: uuid, State: structs.StateUnknown, Meta: make(map[string]string, len(meta))}
+	for field, value := range meta {
+		video.Meta[field] = value
+	}
+
+	if leaseDeadline, ok := s.wip[uuid]; ok {
+		video.State = structs.StateWip
+		video.LeaseExpiresAt = leaseDeadline
+		return video
+	}
+	if notBefore, ok := s.scheduled[uuid]; ok {
+		video.State = structs.StateScheduled
+		video.NotBefore = notBefore
+		return video
+	}
+	if _, ok := s.done[uuid]; ok {
+		video.State = structs.StateDone
+		return video
+	}
+	if _, ok := s.fail[uuid]; ok {
+		video.State = structs.StateFail
+		return video
+	}
+
+	ahead := 0
+	for _, priority := range structs.Priorities {
+		if i := slices.Index(s.queues[priority], uuid); i >= 0 {
+			video.State = structs.StateQueued
+			video.QueuePosition = ahead + i + 1
+			break
+		}
+		ahead += len(s.queues[priority])
+	}
+	return video
+}
+
+func (s *Memory) State(ctx context.Context, uuid string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if video := s.lookup(uuid); video != nil {
+		return video.State, nil
+	}
+	return structs.StateUnknown, nil
+}
+
+func (s *Memory) Lookup(ctx context.Context, uuid string) (*Video, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lookup(uuid), nil
+}
+
+// List orders queued jobs by queue position and the others by score and uuid,
+// with the same cursors as Redis
+func (s *Memory) List(ctx context.Context, state string, filter ListFilter) (*Page, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	page := &Page{Videos: []*Video{}}
+	if state == structs.StateQueued {
+		position := 0
+		if filter.Cursor != "" {
+			var err error
+			position, err = strconv.Atoi(filter.Cursor)
+			if err != nil || position < 0 {
+				return nil, ErrInvalidCursor
+			}
+		}
+		queuePosition := 0
+		for _, priority := range structs.Priorities {
+			for _, uuid := range s.queues[priority] {
+				queuePosition++
+				if queuePosition <= position || !filter.matches(s.meta[uuid], state, true) {
+					continue
+				}
+				page.Videos = append(page.Videos, s.lookup(uuid))
+				if len(page.Videos) == filter.Limit {
+					page.NextCursor = strconv.Itoa(queuePosition)
+					return page, nil
+				}
+			}
+		}
+		return page, nil
+	}
+
+	set := map[string]map[string]int64{
+		structs.StateScheduled: s.scheduled,
+		structs.StateWip:       s.wip,
+		structs.StateDone:      s.done,
+		structs.StateFail:      s.fail,
+	}[state]
+	var afterScore int64
+	var afterUuid string
+	if filter.Cursor != "" {
+		scoreStr, videoUuid, found := strings.Cut(filter.Cursor, ":")
+		score, err := strconv.ParseInt(scoreStr, 10, 64)
+		if !found || err != nil {
+			return nil, ErrInvalidCursor
+		}
+		afterScore, afterUuid = score, videoUuid
+	}
+
+	// The score is the time From and To apply to in every state but wip
+	scoreIsTime := state != structs.StateWip
+	for _, uuid := range dueBy(set, math.MaxInt64) {
+		score := set[uuid]
+		if filter.Cursor != "" && (score < afterScore || (score == afterScore && uuid <= afterUuid)) {
+			continue
+		}
+		if (scoreIsTime && !filter.inRange(score)) || !filter.matches(s.meta[uuid], state, !scoreIsTime) {
+			continue
+		}
+		page.Videos = append(page.Videos, s.lookup(uuid))
+		if len(page.Videos) == filter.Limit {
+			page.NextCursor = fmt.Sprintf("%d:%s", score, uuid)
+			return page, nil
+		}
+	}
+	return page, nil
+}
+
+func (s *Memory) Events(ctx context.Context, uuid string) ([]structs.VideoEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.meta[uuid]; !ok && len(s.events[uuid]) == 0 {
+		return nil, nil
+	}
+	return append([]structs.VideoEvent{}, s.events[uuid]...), nil
+}
+
+func (s *Memory) Stats(ctx context.Context) (*Stats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := &Stats{
+		QueueByPriority: make(map[string]int, len(structs.Priorities)),
+		Scheduled:       len(s.scheduled),
+		Wip:             len(s.wip),
+		Done:            len(s.done),
+		Fail:            len(s.fail),
+		Janitor:         s.janitor,
+	}
+	for _, priority := range structs.Priorities {
+		stats.QueueByPriority[priority] = len(s.queues[priority])
+	}
+	return stats, nil
+}
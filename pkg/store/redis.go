@@ -0,0 +1,1107 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"firecast/pkg/events"
+	"firecast/pkg/structs"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// deleteVideoLua defines deleteVideo(uuid, now), which removes a video's
+// metadata, event log and duplicate index entry and publishes a cancelled
+// event. It is prepended, after events.Lua, to the scripts that can drop a
+// cancelled video.
+const deleteVideoLua = `
+local function deleteVideo(uuid, now)
+	publishEvent(uuid, {type = 'cancelled', at = tonumber(now)})
+	local metaKey = 'videos:meta:' .. uuid
+	local ids = redis.call('HMGET', metaKey, 'video_id', 'playlist_id')
+	if ids[1] and ids[2] then
+		local field = ids[1] .. ':' .. ids[2]
+		if redis.call('HGET', 'videos:index', field) == uuid then
+			redis.call('HDEL', 'videos:index', field)
+		end
+	end
+	redis.call('DEL', metaKey, 'videos:events:' .. uuid)
+end
+`
+
+// addVideoLua defines addVideo(queueKey, uuid, indexField, force, notBefore, now, meta).
+// It stores a new video and queues or schedules it, unless the same video was
+// already added to the same playlist and force is not '1'. meta is a list of
+// field/value pairs. It returns the uuid and "created", or the existing uuid
+// and "existing". It is prepended, after events.Lua, to the scripts that add videos.
+const addVideoLua = `
+local function addVideo(queueKey, uuid, indexField, force, notBefore, now, meta)
+	if force ~= '1' then
+		local existing = redis.call('HGET', 'videos:index', indexField)
+		if existing and redis.call('EXISTS', 'videos:meta:' .. existing) == 1 then
+			return existing, 'existing'
+		end
+	end
+
+	redis.call('HSET', 'videos:meta:' .. uuid, unpack(meta))
+	local event = {type = 'added', at = tonumber(now), priority = redis.call('HGET', 'videos:meta:' .. uuid, 'priority')}
+	if tonumber(notBefore) > 0 then
+		redis.call('ZADD', 'videos:scheduled', notBefore, uuid)
+		event.state = 'scheduled'
+		event.notBefore = tonumber(notBefore)
+	else
+		redis.call('LPUSH', queueKey, uuid)
+		event.state = 'queued'
+	end
+	redis.call('HSET', 'videos:index', indexField, uuid)
+	appendEvent(uuid, event)
+	return uuid, 'created'
+end
+`
+
+// nextAttemptLua defines nextAttemptAfter(retries, first), which picks the next
+// attempt time of a video that made the given number of attempts out of the
+// list the caller passed from ARGV[first] on, see nextAttempts
+const nextAttemptLua = `
+local function nextAttemptAfter(retries, first)
+	local index = math.min(first + math.max(retries, 1) - 1, #ARGV)
+	if index < first then
+		return 0
+	end
+	return tonumber(ARGV[index])
+end
+`
+
+// addScript stores a new video, see addVideoLua.
+// KEYS[1] = queue list of the video's priority
+// ARGV[1] = uuid, ARGV[2] = index field (video id and playlist id), ARGV[3] = force flag
+// ARGV[4] = not before (unix seconds), 0 to queue right away, ARGV[5] = now
+// ARGV[6...] = metadata field/value pairs
+// Returns {uuid, "created"} or {existing uuid, "existing"}.
+var addScript = redis.NewScript(events.Lua + addVideoLua + `
+local meta = {}
+for i = 6, #ARGV do
+	meta[#meta + 1] = ARGV[i]
+end
+local uuid, status = addVideo(KEYS[1], ARGV[1], ARGV[2], ARGV[3], ARGV[4], ARGV[5], meta)
+return {uuid, status}
+`)
+
+// claimScript pops the oldest video of the highest non-empty priority, leases it
+// in the wip set, records the attempt token and bumps its retry counter in one
+// atomic step.
+// KEYS[1..n-2] = queue lists, highest priority first
+// KEYS[n-1] = videos:wip, KEYS[n] = videos:fail
+// ARGV[1] = lease deadline (unix seconds), stored as the wip score
+// ARGV[2] = attempt token, ARGV[3] = now, ARGV[4] = worker name, may be empty
+// Returns nil when the queue is empty, otherwise {uuid, field, value, ...}.
+// A uuid without metadata is moved to the fail set and returned without fields.
+// If videos are left in the queue, the next waiting worker is woken up.
+var claimScript = redis.NewScript(events.Lua + `
+local wipKey = KEYS[#KEYS - 1]
+local failKey = KEYS[#KEYS]
+
+local uuid
+for i = 1, #KEYS - 2 do
+	uuid = redis.call('RPOP', KEYS[i])
+	if uuid then
+		break
+	end
+end
+if not uuid then
+	return false
+end
+for i = 1, #KEYS - 2 do
+	if redis.call('LLEN', KEYS[i]) > 0 then
+		notifyWorkers()
+		break
+	end
+end
+
+local metaKey = 'videos:meta:' .. uuid
+if redis.call('EXISTS', metaKey) == 0 then
+	redis.call('ZADD', failKey, ARGV[3], uuid)
+	return {uuid}
+end
+
+redis.call('ZADD', wipKey, ARGV[1], uuid)
+local attempt = redis.call('HINCRBY', metaKey, 'retries', 1)
+redis.call('HSET', metaKey, 'attempt_token', ARGV[2], 'claimed_at', ARGV[3], 'worker', ARGV[4])
+appendEvent(uuid, {type = 'claimed', at = tonumber(ARGV[3]), state = 'wip', worker = ARGV[4] ~= '' and ARGV[4] or nil, attempt = attempt})
+
+local result = {uuid}
+local meta = redis.call('HGETALL', metaKey)
+for i = 1, #meta do
+	result[#result + 1] = meta[i]
+end
+return result
+`)
+
+// completeScript moves an in-progress video from the wip set into the done set,
+// which is scored by the time the video finished.
+// KEYS[1] = videos:wip, KEYS[2] = videos:done, KEYS[3] = videos:fail
+// ARGV[1] = uuid, ARGV[2] = attempt token, ARGV[3] = now
+// Returns "ok", "stale" if the token does not belong to the current attempt,
+// "done" or "fail" if the video already finished, "not_wip", or "cancelled"
+// if the video was cancelled while in progress, in which case it is dropped.
+var completeScript = redis.NewScript(events.Lua + deleteVideoLua + `
+if redis.call('HGET', 'videos:meta:' .. ARGV[1], 'attempt_token') ~= ARGV[2] then
+	return 'stale'
+end
+if redis.call('HEXISTS', 'videos:meta:' .. ARGV[1], 'cancelled_at') == 1 then
+	redis.call('ZREM', KEYS[1], ARGV[1])
+	deleteVideo(ARGV[1], ARGV[3])
+	return 'cancelled'
+end
+if redis.call('ZSCORE', KEYS[2], ARGV[1]) then
+	return 'done'
+end
+if redis.call('ZSCORE', KEYS[3], ARGV[1]) then
+	return 'fail'
+end
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return 'not_wip'
+end
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[1])
+redis.call('HSET', 'videos:meta:' .. ARGV[1], 'finished_at', ARGV[3])
+appendEvent(ARGV[1], {type = 'done', at = tonumber(ARGV[3]), state = 'done'})
+return 'ok'
+`)
+
+// heartbeatScript pushes the lease deadline of an in-progress video forward and
+// publishes a progress event if the worker reported a stage.
+// KEYS[1] = videos:wip
+// ARGV[1] = uuid, ARGV[2] = new lease deadline (unix seconds), ARGV[3] = attempt token
+// ARGV[4] = stage, may be empty, ARGV[5] = now
+// Returns "ok", "stale" if the token does not belong to the current attempt,
+// "not_wip" if the lease was already lost, or "cancelled" if the worker should stop.
+var heartbeatScript = redis.NewScript(events.Lua + `
+if redis.call('HGET', 'videos:meta:' .. ARGV[1], 'attempt_token') ~= ARGV[3] then
+	return 'stale'
+end
+if redis.call('HEXISTS', 'videos:meta:' .. ARGV[1], 'cancelled_at') == 1 then
+	return 'cancelled'
+end
+if not redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	return 'not_wip'
+end
+redis.call('ZADD', KEYS[1], 'XX', ARGV[2], ARGV[1])
+if ARGV[4] ~= '' then
+	publishEvent(ARGV[1], {type = 'progress', at = tonumber(ARGV[5]), state = 'wip', stage = ARGV[4]})
+end
+return 'ok'
+`)
+
+// failScript records why an in-progress video failed and then either schedules
+// it for another attempt or moves it into the fail set.
+// Only transient failures are retried, and only while the retry counter is
+// below the maximum, which is read here so it cannot change in between.
+// KEYS[1] = videos:wip, KEYS[2] = videos:done, KEYS[3] = videos:fail,
+// KEYS[4] = queue list of the video's priority, KEYS[5] = videos:scheduled
+// ARGV[1] = uuid, ARGV[2] = attempt token, ARGV[3] = max retries, ARGV[4] = now,
+// ARGV[5] = error, ARGV[6] = stage, ARGV[7] = class
+// ARGV[8...] = next attempt at after 1, 2, ... attempts, see nextAttempts
+// Returns {status, next attempt at}, where status is "ok", "scheduled" or
+// "queue", or the same errors as completeScript.
+var failScript = redis.NewScript(events.Lua + deleteVideoLua + nextAttemptLua + `
+local metaKey = 'videos:meta:' .. ARGV[1]
+local retries = tonumber(redis.call('HGET', metaKey, 'retries') or '0')
+local nextAttemptAt = nextAttemptAfter(retries, 8)
+if redis.call('HGET', metaKey, 'attempt_token') ~= ARGV[2] then
+	return {'stale', nextAttemptAt}
+end
+if redis.call('HEXISTS', metaKey, 'cancelled_at') == 1 then
+	redis.call('ZREM', KEYS[1], ARGV[1])
+	deleteVideo(ARGV[1], ARGV[4])
+	return {'cancelled', nextAttemptAt}
+end
+if redis.call('ZSCORE', KEYS[2], ARGV[1]) then
+	return {'done', nextAttemptAt}
+end
+if redis.call('ZSCORE', KEYS[3], ARGV[1]) then
+	return {'fail', nextAttemptAt}
+end
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return {'not_wip', nextAttemptAt}
+end
+
+redis.call('HSET', metaKey,
+	'last_error', ARGV[5],
+	'last_error_stage', ARGV[6],
+	'last_error_class', ARGV[7],
+	'last_error_at', ARGV[4])
+local event = {type = 'attempt_failed', at = tonumber(ARGV[4]), error = ARGV[5], stage = ARGV[6], class = ARGV[7]}
+
+if ARGV[7] ~= 'transient' or retries >= tonumber(ARGV[3]) then
+	redis.call('ZADD', KEYS[3], ARGV[4], ARGV[1])
+	redis.call('HSET', metaKey, 'finished_at', ARGV[4])
+	event.type = 'failed'
+	event.state = 'fail'
+	appendEvent(ARGV[1], event)
+	return {'ok', nextAttemptAt}
+end
+
+redis.call('HDEL', metaKey, 'attempt_token')
+redis.call('HSET', metaKey, 'last_attempt_at', ARGV[4], 'not_before', nextAttemptAt)
+if nextAttemptAt > tonumber(ARGV[4]) then
+	redis.call('ZADD', KEYS[5], nextAttemptAt, ARGV[1])
+	event.state = 'scheduled'
+	event.notBefore = nextAttemptAt
+	appendEvent(ARGV[1], event)
+	return {'scheduled', nextAttemptAt}
+end
+redis.call('LPUSH', KEYS[4], ARGV[1])
+event.state = 'queued'
+appendEvent(ARGV[1], event)
+return {'queue', nextAttemptAt}
+`)
+
+// recoverScript moves one video with an expired lease out of the wip set. It is
+// scheduled for a retry once its backoff has passed, queued right away if there
+// is no backoff, or moved into the fail set once it has used up its retries.
+// KEYS[1] = videos:wip, KEYS[2] = videos:fail, KEYS[3] = queue list of the video's priority,
+// KEYS[4] = videos:scheduled
+// ARGV[1] = uuid, ARGV[2] = max retries, ARGV[3] = now
+// ARGV[4...] = next attempt at after 1, 2, ... attempts, see nextAttempts
+// Returns {status, next attempt at}, where status is "queue", "scheduled",
+// "fail", "cancelled" if the video was dropped, or "skip" if the lease was
+// renewed in the meantime.
+var recoverScript = redis.NewScript(events.Lua + deleteVideoLua + nextAttemptLua + `
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not score or tonumber(score) > tonumber(ARGV[3]) then
+	return {'skip', 0}
+end
+redis.call('ZREM', KEYS[1], ARGV[1])
+
+-- A cancelled video is dropped instead of retried
+local metaKey = 'videos:meta:' .. ARGV[1]
+if redis.call('HEXISTS', metaKey, 'cancelled_at') == 1 then
+	deleteVideo(ARGV[1], ARGV[3])
+	return {'cancelled', 0}
+end
+
+-- Invalidate the expired attempt so its worker can no longer complete it
+redis.call('HDEL', metaKey, 'attempt_token')
+local retries = tonumber(redis.call('HGET', metaKey, 'retries') or '0')
+local nextAttemptAt = nextAttemptAfter(retries, 4)
+if retries >= tonumber(ARGV[2]) then
+	redis.call('ZADD', KEYS[2], ARGV[3], ARGV[1])
+	redis.call('HSET', metaKey, 'finished_at', ARGV[3])
+	appendEvent(ARGV[1], {type = 'failed', at = tonumber(ARGV[3]), state = 'fail', error = '` + leaseExpiredError + `'})
+	return {'fail', nextAttemptAt}
+end
+
+redis.call('HSET', metaKey, 'last_attempt_at', ARGV[3], 'not_before', nextAttemptAt)
+if nextAttemptAt > tonumber(ARGV[3]) then
+	redis.call('ZADD', KEYS[4], nextAttemptAt, ARGV[1])
+	appendEvent(ARGV[1], {type = 'timed_out', at = tonumber(ARGV[3]), state = 'scheduled', notBefore = nextAttemptAt})
+	return {'scheduled', nextAttemptAt}
+end
+redis.call('LPUSH', KEYS[3], ARGV[1])
+appendEvent(ARGV[1], {type = 'timed_out', at = tonumber(ARGV[3]), state = 'queued'})
+return {'queue', nextAttemptAt}
+`)
+
+// expandScript completes an expand job by adding its children, skipping those
+// that were already added to the same playlist. The expand job moves into the
+// done set and tracks the progress of the videos it created.
+// KEYS[1] = videos:wip, KEYS[2] = videos:done, KEYS[3] = videos:fail
+// ARGV[1] = uuid, ARGV[2] = attempt token, ARGV[3] = now
+// ARGV[4...] = one expandEntry JSON object per child
+// Returns {"ok", uuid, "created" or "existing", ...} per child, or {error} with
+// the same errors as completeScript.
+var expandScript = redis.NewScript(events.Lua + deleteVideoLua + addVideoLua + `
+local metaKey = 'videos:meta:' .. ARGV[1]
+if redis.call('HGET', metaKey, 'attempt_token') ~= ARGV[2] then
+	return {'stale'}
+end
+if redis.call('HEXISTS', metaKey, 'cancelled_at') == 1 then
+	redis.call('ZREM', KEYS[1], ARGV[1])
+	deleteVideo(ARGV[1], ARGV[3])
+	return {'cancelled'}
+end
+if redis.call('ZSCORE', KEYS[2], ARGV[1]) then
+	return {'done'}
+end
+if redis.call('ZSCORE', KEYS[3], ARGV[1]) then
+	return {'fail'}
+end
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return {'not_wip'}
+end
+
+local result = {'ok'}
+local created, duplicates = 0, 0
+for i = 4, #ARGV do
+	local entry = cjson.decode(ARGV[i])
+	local uuid, status = addVideo(entry.queue, entry.uuid, entry.index, entry.force, entry.notBefore, ARGV[3], entry.meta)
+	if status == 'created' then
+		created = created + 1
+	else
+		duplicates = duplicates + 1
+	end
+	result[#result + 1] = uuid
+	result[#result + 1] = status
+end
+
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[1])
+redis.call('HSET', metaKey,
+	'finished_at', ARGV[3],
+	'children_total', created,
+	'children_duplicate', duplicates,
+	'children_done', 0,
+	'children_failed', 0,
+	'children_cancelled', 0)
+appendEvent(ARGV[1], {type = 'expanded', at = tonumber(ARGV[3]), state = 'done', children = created, duplicates = duplicates})
+return result
+`)
+
+// cancelScript removes a queued or scheduled video, or flags an in-progress one
+// as cancelled so its worker stops on the next heartbeat or completion call.
+// KEYS[1] = queue list of the video's priority, KEYS[2] = videos:scheduled,
+// KEYS[3] = videos:wip, KEYS[4] = videos:done, KEYS[5] = videos:fail
+// ARGV[1] = uuid, ARGV[2] = now
+// Returns "deleted", "cancelling", "finished" or "missing".
+var cancelScript = redis.NewScript(events.Lua + deleteVideoLua + `
+local metaKey = 'videos:meta:' .. ARGV[1]
+if redis.call('EXISTS', metaKey) == 0 then
+	return 'missing'
+end
+if redis.call('ZSCORE', KEYS[3], ARGV[1]) then
+	redis.call('HSET', metaKey, 'cancelled_at', ARGV[2])
+	appendEvent(ARGV[1], {type = 'cancel_requested', at = tonumber(ARGV[2]), state = 'wip'})
+	return 'cancelling'
+end
+if redis.call('ZSCORE', KEYS[4], ARGV[1]) or redis.call('ZSCORE', KEYS[5], ARGV[1]) then
+	return 'finished'
+end
+
+redis.call('LREM', KEYS[1], 0, ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+deleteVideo(ARGV[1], ARGV[2])
+return 'deleted'
+`)
+
+// retryScript moves a failed video back into its queue.
+// KEYS[1] = videos:fail, KEYS[2] = queue list of the video's priority
+// ARGV[1] = uuid, ARGV[2] = reset retries flag, ARGV[3] = now
+// Returns "ok", "missing" if the video does not exist or "not_failed".
+var retryScript = redis.NewScript(events.Lua + `
+local metaKey = 'videos:meta:' .. ARGV[1]
+if redis.call('EXISTS', metaKey) == 0 then
+	return 'missing'
+end
+if not redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	return 'not_failed'
+end
+
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('HDEL', metaKey, 'finished_at', 'attempt_token')
+redis.call('HSET', metaKey, 'last_attempt_at', ARGV[3], 'not_before', 0)
+if ARGV[2] == '1' then
+	redis.call('HSET', metaKey, 'retries', 0)
+end
+redis.call('LPUSH', KEYS[2], ARGV[1])
+appendEvent(ARGV[1], {type = 'retried', at = tonumber(ARGV[3]), state = 'queued'})
+return 'ok'
+`)
+
+// promoteScript moves one due video from the scheduled set into its queue.
+// KEYS[1] = videos:scheduled, KEYS[2] = queue list of the video's priority
+// ARGV[1] = uuid, ARGV[2] = now
+// Returns "queue" or "skip" if the video is no longer scheduled or not yet due.
+var promoteScript = redis.NewScript(events.Lua + `
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not score or tonumber(score) > tonumber(ARGV[2]) then
+	return 'skip'
+end
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('LPUSH', KEYS[2], ARGV[1])
+appendEvent(ARGV[1], {type = 'promoted', at = tonumber(ARGV[2]), state = 'queued'})
+return 'queue'
+`)
+
+// pruneBatchSize is how many videos one run of pruneScript removes at most, so
+// a large backlog does not block Redis
+const pruneBatchSize = 100
+
+// pruneScript removes a batch of videos that finished before the cutoff from a
+// terminal set, together with their metadata, event log and duplicate index entry.
+// KEYS[1] = videos:done or videos:fail, KEYS[2] = videos:index
+// ARGV[1] = cutoff (unix seconds), ARGV[2] = batch size
+// Returns the number of pruned videos.
+var pruneScript = redis.NewScript(`
+local uuids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, tonumber(ARGV[2]))
+for _, uuid in ipairs(uuids) do
+	redis.call('ZREM', KEYS[1], uuid)
+	local metaKey = 'videos:meta:' .. uuid
+	local ids = redis.call('HMGET', metaKey, 'video_id', 'playlist_id')
+	if ids[1] and ids[2] and redis.call('HGET', KEYS[2], ids[1] .. ':' .. ids[2]) == uuid then
+		redis.call('HDEL', KEYS[2], ids[1] .. ':' .. ids[2])
+	end
+	redis.call('DEL', metaKey, 'videos:events:' .. uuid)
+end
+return #uuids
+`)
+
+// maxBlockingWaits caps the BLPOPs Wait keeps open at once. Waits beyond it
+// poll every redisPollInterval instead.
+const (
+	maxBlockingWaits  = 32
+	redisPollInterval = time.Second
+)
+
+// Redis is the Store behind the server. Jobs live in the videos:* keys, and
+// every transition also records and publishes its event, see events.Lua.
+type Redis struct {
+	rdb *redis.Client
+	// waiter has its own connections for the BLPOPs of Wait, so long polls
+	// cannot take the pool every other request shares
+	waiter *redis.Client
+	waits  chan struct{}
+	config Config
+}
+
+// NewRedis returns a store on the videos:* keys of a Redis database
+func NewRedis(rdb *redis.Client, config Config) *Redis {
+	waiterOptions := *rdb.Options()
+	waiterOptions.PoolSize = maxBlockingWaits
+	waiterOptions.MinIdleConns = 0
+	return &Redis{
+		rdb:    rdb,
+		waiter: redis.NewClient(&waiterOptions),
+		waits:  make(chan struct{}, maxBlockingWaits),
+		config: config,
+	}
+}
+
+// Close closes the connections of Wait. The Redis client passed to NewRedis is
+// left open.
+func (s *Redis) Close() error {
+	return s.waiter.Close()
+}
+
+func metaKey(uuid string) string {
+	return fmt.Sprintf("videos:meta:%s", uuid)
+}
+
+// stateKeys are the sorted sets behind every state but queued. The score is the
+// time a scheduled video is due, the lease deadline of a video in progress and
+// the time a done or failed video finished.
+var stateKeys = map[string]string{
+	structs.StateScheduled: "videos:scheduled",
+	structs.StateWip:       "videos:wip",
+	structs.StateDone:      "videos:done",
+	structs.StateFail:      "videos:fail",
+}
+
+// priority returns the priority of a video, which never changes after it was
+// added, so scripts can be given the right queue key up front
+func (s *Redis) priority(ctx context.Context, uuid string) (string, error) {
+	priority, err := s.rdb.HGet(ctx, metaKey(uuid), "priority").Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return priority, err
+}
+
+// Enqueue runs the add scripts back to back in MULTI, so duplicates within one
+// call resolve to the first occurrence just like separate calls would
+func (s *Redis) Enqueue(ctx context.Context, jobs []*Job, now time.Time) ([]EnqueueResult, error) {
+	cmds := make([]*redis.Cmd, len(jobs))
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, job := range jobs {
+			args := append([]interface{}{job.Uuid, job.IndexField, job.Force, job.NotBefore, now.Unix()}, job.Meta...)
+			cmds[i] = addScript.Eval(ctx, pipe, []string{structs.QueueKey(job.Priority)}, args...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]EnqueueResult, len(jobs))
+	for i, cmd := range cmds {
+		result, err := cmd.StringSlice()
+		if err != nil {
+			return nil, err
+		}
+		results[i] = EnqueueResult{Uuid: result[0], Duplicate: result[1] == "existing"}
+	}
+	return results, nil
+}
+
+func (s *Redis) Claim(ctx context.Context, token, worker string, now time.Time) (*Claim, error) {
+	leaseDeadline := now.Add(s.config.LeaseDuration).Unix()
+	result, err := claimScript.Run(ctx, s.rdb,
+		append(structs.QueueKeys(), "videos:wip", "videos:fail"),
+		leaseDeadline, token, now.Unix(), worker,
+	).StringSlice()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	claim := &Claim{Uuid: result[0], LeaseExpiresAt: leaseDeadline}
+	if len(result) == 1 {
+		return claim, nil
+	}
+	claim.Meta = make(map[string]string, (len(result)-1)/2)
+	for i := 1; i+1 < len(result); i += 2 {
+		claim.Meta[result[i]] = result[i+1]
+	}
+	return claim, nil
+}
+
+// Wait blocks on events.NotifyKey, which the scripts push to whenever a video
+// is queued. When maxBlockingWaits are already blocked it sleeps for up to
+// redisPollInterval instead, so the caller checks the queues again.
+func (s *Redis) Wait(ctx context.Context, timeout time.Duration) error {
+	select {
+	case s.waits <- struct{}{}:
+		defer func() {
+			<-s.waits
+		}()
+	default:
+		timer := time.NewTimer(min(timeout, redisPollInterval))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	err := s.waiter.BLPop(ctx, timeout, events.NotifyKey).Err()
+	if err == redis.Nil {
+		return nil
+	}
+	return err
+}
+
+func (s *Redis) Heartbeat(ctx context.Context, uuid, token, stage string, now time.Time) (string, int64, error) {
+	leaseDeadline := now.Add(s.config.LeaseDuration).Unix()
+	status, err := heartbeatScript.Run(ctx, s.rdb,
+		[]string{"videos:wip"},
+		uuid, leaseDeadline, token, stage, now.Unix(),
+	).Text()
+	return status, leaseDeadline, err
+}
+
+func (s *Redis) Complete(ctx context.Context, uuid, token string, now time.Time) (string, error) {
+	return completeScript.Run(ctx, s.rdb,
+		[]string{"videos:wip", "videos:done", "videos:fail"},
+		uuid, token, now.Unix(),
+	).Text()
+}
+
+// Fail leaves the decision whether the video is retried to failScript
+func (s *Redis) Fail(ctx context.Context, uuid, token string, failure Failure, now time.Time) (string, int64, error) {
+	priority, err := s.priority(ctx, uuid)
+	if err != nil {
+		return "", 0, err
+	}
+
+	args := append([]interface{}{uuid, token, s.config.MaxRetries, now.Unix(), failure.Error, failure.Stage, failure.Class},
+		s.config.nextAttempts(now)...)
+	result, err := failScript.Run(ctx, s.rdb,
+		[]string{"videos:wip", "videos:done", "videos:fail", structs.QueueKey(priority), "videos:scheduled"},
+		args...,
+	).Slice()
+	if err != nil {
+		return "", 0, err
+	}
+	status, nextAttemptAt := scriptStatus(result)
+	return status, nextAttemptAt, nil
+}
+
+// Recover scans the wip set, whose score is the lease deadline, so anything at
+// or below now has expired
+func (s *Redis) Recover(ctx context.Context, now time.Time) ([]Recovery, error) {
+	wipVideos, err := s.rdb.ZRangeByScore(ctx, "videos:wip", &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now.Unix(), 10),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	nextAttempts := s.config.nextAttempts(now)
+	var recovered []Recovery
+	for _, videoUuid := range wipVideos {
+		priority, err := s.priority(ctx, videoUuid)
+		if err != nil {
+			log.Printf("Error getting meta for %s: %v", videoUuid, err)
+			continue
+		}
+
+		args := append([]interface{}{videoUuid, s.config.MaxRetries, now.Unix()}, nextAttempts...)
+		result, err := recoverScript.Run(ctx, s.rdb,
+			[]string{"videos:wip", "videos:fail", structs.QueueKey(priority), "videos:scheduled"},
+			args...,
+		).Slice()
+		if err != nil {
+			log.Printf("Error recovering %s from wip: %v", videoUuid, err)
+			continue
+		}
+		status, nextAttemptAt := scriptStatus(result)
+		if status != "skip" {
+			recovered = append(recovered, Recovery{Uuid: videoUuid, Status: status, NotBefore: nextAttemptAt})
+		}
+	}
+	return recovered, nil
+}
+
+// scriptStatus splits the {status, next attempt at} reply of failScript and recoverScript
+func scriptStatus(result []interface{}) (string, int64) {
+	status, _ := result[0].(string)
+	nextAttemptAt, _ := result[1].(int64)
+	return status, nextAttemptAt
+}
+
+func (s *Redis) State(ctx context.Context, uuid string) (string, error) {
+	pipe := s.rdb.Pipeline()
+	sets := map[string]*redis.FloatCmd{}
+	for state, key := range stateKeys {
+		sets[state] = pipe.ZScore(ctx, key, uuid)
+	}
+	positions := make([]*redis.IntCmd, 0, len(structs.Priorities))
+	for _, queueKey := range structs.QueueKeys() {
+		positions = append(positions, pipe.LPos(ctx, queueKey, uuid, redis.LPosArgs{}))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return "", err
+	}
+
+	for state, cmd := range sets {
+		if cmd.Err() == nil {
+			return state, nil
+		}
+	}
+	for _, cmd := range positions {
+		if cmd.Err() == nil {
+			return structs.StateQueued, nil
+		}
+	}
+	return structs.StateUnknown, nil
+}
+
+func (s *Redis) Stats(ctx context.Context) (*Stats, error) {
+	pipe := s.rdb.Pipeline()
+	wip := pipe.ZCard(ctx, "videos:wip")
+	done := pipe.ZCard(ctx, "videos:done")
+	fail := pipe.ZCard(ctx, "videos:fail")
+	scheduled := pipe.ZCard(ctx, "videos:scheduled")
+	queues := make(map[string]*redis.IntCmd, len(structs.Priorities))
+	for _, priority := range structs.Priorities {
+		queues[priority] = pipe.LLen(ctx, structs.QueueKey(priority))
+	}
+	janitorStats := pipe.HGetAll(ctx, "videos:janitor")
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{
+		QueueByPriority: make(map[string]int, len(queues)),
+		Scheduled:       int(scheduled.Val()),
+		Wip:             int(wip.Val()),
+		Done:            int(done.Val()),
+		Fail:            int(fail.Val()),
+	}
+	for priority, cmd := range queues {
+		stats.QueueByPriority[priority] = int(cmd.Val())
+	}
+
+	janitor := janitorStats.Val()
+	stats.Janitor.LastRunAt, _ = strconv.ParseInt(janitor["last_run_at"], 10, 64)
+	stats.Janitor.DonePruned, _ = strconv.Atoi(janitor["done_pruned"])
+	stats.Janitor.FailPruned, _ = strconv.Atoi(janitor["fail_pruned"])
+	stats.Janitor.LastDonePruned, _ = strconv.Atoi(janitor["last_done_pruned"])
+	stats.Janitor.LastFailPruned, _ = strconv.Atoi(janitor["last_fail_pruned"])
+	return stats, nil
+}
+
+// expandEntry carries the addVideo arguments of one child into expandScript
+type expandEntry struct {
+	Queue     string   `json:"queue"`
+	Uuid      string   `json:"uuid"`
+	Index     string   `json:"index"`
+	Force     string   `json:"force"`
+	NotBefore int64    `json:"notBefore"`
+	Meta      []string `json:"meta"`
+}
+
+func (s *Redis) Expand(ctx context.Context, uuid, token string, children []*Job, now time.Time) (string, []EnqueueResult, error) {
+	args := []interface{}{uuid, token, now.Unix()}
+	for _, child := range children {
+		entry := expandEntry{
+			Queue:     structs.QueueKey(child.Priority),
+			Uuid:      child.Uuid,
+			Index:     child.IndexField,
+			Force:     "0",
+			NotBefore: child.NotBefore,
+		}
+		if child.Force {
+			entry.Force = "1"
+		}
+		for _, value := range child.Meta {
+			entry.Meta = append(entry.Meta, fmt.Sprint(value))
+		}
+		entry.Meta = append(entry.Meta, "parent", uuid)
+		entryJSON, err := json.Marshal(entry)
+		if err != nil {
+			return "", nil, err
+		}
+		args = append(args, entryJSON)
+	}
+
+	result, err := expandScript.Run(ctx, s.rdb,
+		[]string{"videos:wip", "videos:done", "videos:fail"},
+		args...,
+	).StringSlice()
+	if err != nil {
+		return "", nil, err
+	}
+	if result[0] != "ok" {
+		return result[0], nil, nil
+	}
+
+	results := make([]EnqueueResult, len(children))
+	for i := range children {
+		results[i] = EnqueueResult{Uuid: result[1+2*i], Duplicate: result[2+2*i] == "existing"}
+	}
+	return "ok", results, nil
+}
+
+func (s *Redis) Cancel(ctx context.Context, uuid string, now time.Time) (string, error) {
+	priority, err := s.priority(ctx, uuid)
+	if err != nil {
+		return "", err
+	}
+	return cancelScript.Run(ctx, s.rdb,
+		[]string{structs.QueueKey(priority), "videos:scheduled", "videos:wip", "videos:done", "videos:fail"},
+		uuid, now.Unix(),
+	).Text()
+}
+
+func (s *Redis) Retry(ctx context.Context, uuid string, resetRetries bool, now time.Time) (string, error) {
+	priority, err := s.priority(ctx, uuid)
+	if err != nil {
+		return "", err
+	}
+	return retryScript.Run(ctx, s.rdb,
+		[]string{"videos:fail", structs.QueueKey(priority)},
+		uuid, resetRetries, now.Unix(),
+	).Text()
+}
+
+// Promote scans the scheduled set, whose score is the time a video becomes due
+func (s *Redis) Promote(ctx context.Context, now time.Time) (int, error) {
+	dueVideos, err := s.rdb.ZRangeByScore(ctx, "videos:scheduled", &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now.Unix(), 10),
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	promoted := 0
+	for _, videoUuid := range dueVideos {
+		priority, err := s.priority(ctx, videoUuid)
+		if err != nil {
+			log.Printf("Error getting priority for %s: %v", videoUuid, err)
+			continue
+		}
+
+		status, err := promoteScript.Run(ctx, s.rdb,
+			[]string{"videos:scheduled", structs.QueueKey(priority)},
+			videoUuid, now.Unix(),
+		).Text()
+		if err != nil {
+			log.Printf("Error promoting %s to queue: %v", videoUuid, err)
+			continue
+		}
+		if status == "queue" {
+			promoted++
+		}
+	}
+	return promoted, nil
+}
+
+// Prune keeps its counts in the videos:janitor hash
+func (s *Redis) Prune(ctx context.Context, cutoffs map[string]int64, now time.Time) (map[string]int, error) {
+	pruned := make(map[string]int, len(cutoffs))
+	stats := []any{"last_run_at", now.Unix()}
+	for _, state := range []string{structs.StateDone, structs.StateFail} {
+		cutoff, ok := cutoffs[state]
+		if !ok {
+			continue
+		}
+
+		for {
+			batch, err := pruneScript.Run(ctx, s.rdb, []string{stateKeys[state], "videos:index"}, cutoff, pruneBatchSize).Int()
+			if err != nil {
+				return pruned, err
+			}
+			pruned[state] += batch
+			if batch < pruneBatchSize {
+				break
+			}
+		}
+		if pruned[state] > 0 {
+			if err := s.rdb.HIncrBy(ctx, "videos:janitor", state+"_pruned", int64(pruned[state])).Err(); err != nil {
+				return pruned, err
+			}
+		}
+		stats = append(stats, "last_"+state+"_pruned", pruned[state])
+	}
+	return pruned, s.rdb.HSet(ctx, "videos:janitor", stats...).Err()
+}
+
+func (s *Redis) Lookup(ctx context.Context, uuid string) (*Video, error) {
+	queueKeys := structs.QueueKeys()
+
+	pipe := s.rdb.Pipeline()
+	meta := pipe.HGetAll(ctx, metaKey(uuid))
+	scores := make(map[string]*redis.FloatCmd, len(stateKeys))
+	for state, key := range stateKeys {
+		scores[state] = pipe.ZScore(ctx, key, uuid)
+	}
+	positions := make([]*redis.IntCmd, 0, len(queueKeys))
+	lengths := make([]*redis.IntCmd, 0, len(queueKeys))
+	for _, queueKey := range queueKeys {
+		positions = append(positions, pipe.LPos(ctx, queueKey, uuid, redis.LPosArgs{}))
+		lengths = append(lengths, pipe.LLen(ctx, queueKey))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if len(meta.Val()) == 0 {
+		return nil, nil
+	}
+
+	video := &Video{Uuid: uuid, State: structs.StateUnknown, Meta: meta.Val()}
+	for _, state := range []string{structs.StateWip, structs.StateScheduled, structs.StateDone, structs.StateFail} {
+		cmd := scores[state]
+		if cmd.Err() != nil {
+			continue
+		}
+		video.State = state
+		switch state {
+		case structs.StateWip:
+			video.LeaseExpiresAt = int64(cmd.Val())
+		case structs.StateScheduled:
+			video.NotBefore = int64(cmd.Val())
+		}
+		return video, nil
+	}
+
+	// Workers pop from the right and higher priorities go first, so everything
+	// in higher priority lists and to the right of the video is ahead of it
+	ahead := 0
+	for i, cmd := range positions {
+		if cmd.Err() == nil {
+			video.State = structs.StateQueued
+			video.QueuePosition = ahead + int(lengths[i].Val()-cmd.Val())
+			break
+		}
+		ahead += int(lengths[i].Val())
+	}
+	return video, nil
+}
+
+func (s *Redis) List(ctx context.Context, state string, filter ListFilter) (*Page, error) {
+	if state == structs.StateQueued {
+		return s.listQueue(ctx, filter)
+	}
+	return s.listSortedSet(ctx, state, filter)
+}
+
+// fetchMeta loads the metadata of a batch of videos in one round trip
+func (s *Redis) fetchMeta(ctx context.Context, uuids []string) ([]map[string]string, error) {
+	pipe := s.rdb.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(uuids))
+	for i, videoUuid := range uuids {
+		cmds[i] = pipe.HGetAll(ctx, metaKey(videoUuid))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	metas := make([]map[string]string, len(uuids))
+	for i, cmd := range cmds {
+		metas[i] = cmd.Val()
+	}
+	return metas, nil
+}
+
+// listSortedSet pages through a sorted set in score order. The cursor is the
+// score and uuid of the last returned entry, so entries removed between pages
+// do not shift the remaining ones.
+func (s *Redis) listSortedSet(ctx context.Context, state string, filter ListFilter) (*Page, error) {
+	// The score is the time From and To apply to in every state but wip
+	scoreIsTime := state != structs.StateWip
+
+	minScore := "-inf"
+	maxScore := "+inf"
+	var afterScore int64
+	var afterUuid string
+	if filter.Cursor != "" {
+		scoreStr, videoUuid, found := strings.Cut(filter.Cursor, ":")
+		score, err := strconv.ParseInt(scoreStr, 10, 64)
+		if !found || err != nil {
+			return nil, ErrInvalidCursor
+		}
+		afterScore, afterUuid = score, videoUuid
+		minScore = scoreStr
+	}
+	if scoreIsTime {
+		if filter.From != 0 && (filter.Cursor == "" || filter.From > afterScore) {
+			minScore = strconv.FormatInt(filter.From, 10)
+		}
+		if filter.To != 0 {
+			maxScore = strconv.FormatInt(filter.To, 10)
+		}
+	}
+
+	page := &Page{Videos: []*Video{}}
+	var offset int64
+	for {
+		batch, err := s.rdb.ZRangeByScoreWithScores(ctx, stateKeys[state], &redis.ZRangeBy{
+			Min:    minScore,
+			Max:    maxScore,
+			Offset: offset,
+			Count:  int64(filter.Limit),
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+		offset += int64(len(batch))
+
+		uuids := make([]string, len(batch))
+		for i, z := range batch {
+			uuids[i] = z.Member.(string)
+		}
+		metas, err := s.fetchMeta(ctx, uuids)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, z := range batch {
+			score := int64(z.Score)
+			if filter.Cursor != "" && score == afterScore && uuids[i] <= afterUuid {
+				continue
+			}
+			if !filter.matches(metas[i], state, !scoreIsTime) {
+				continue
+			}
+
+			video := &Video{Uuid: uuids[i], State: state, Meta: metas[i]}
+			switch state {
+			case structs.StateWip:
+				video.LeaseExpiresAt = score
+			case structs.StateScheduled:
+				video.NotBefore = score
+			}
+			page.Videos = append(page.Videos, video)
+
+			if len(page.Videos) == filter.Limit {
+				page.NextCursor = fmt.Sprintf("%d:%s", score, uuids[i])
+				return page, nil
+			}
+		}
+
+		if len(batch) < filter.Limit {
+			return page, nil
+		}
+	}
+}
+
+// listQueue pages through the queue in the order videos will be claimed.
+// The cursor is the queue position of the last returned entry.
+func (s *Redis) listQueue(ctx context.Context, filter ListFilter) (*Page, error) {
+	position := 0
+	if filter.Cursor != "" {
+		var err error
+		position, err = strconv.Atoi(filter.Cursor)
+		if err != nil || position < 0 {
+			return nil, ErrInvalidCursor
+		}
+	}
+
+	page := &Page{Videos: []*Video{}}
+	ahead := 0
+	for _, queueKey := range structs.QueueKeys() {
+		length, err := s.rdb.LLen(ctx, queueKey).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		// Workers pop from the right, so queue position p in this list is index -p
+		for start := max(position-ahead, 0) + 1; start <= int(length); start += filter.Limit {
+			end := min(start+filter.Limit-1, int(length))
+			batch, err := s.rdb.LRange(ctx, queueKey, int64(-end), int64(-start)).Result()
+			if err != nil {
+				return nil, err
+			}
+			metas, err := s.fetchMeta(ctx, batch)
+			if err != nil {
+				return nil, err
+			}
+
+			for i := len(batch) - 1; i >= 0; i-- {
+				queuePosition := ahead + start + (len(batch) - 1 - i)
+				if !filter.matches(metas[i], structs.StateQueued, true) {
+					continue
+				}
+
+				page.Videos = append(page.Videos, &Video{
+					Uuid:          batch[i],
+					State:         structs.StateQueued,
+					Meta:          metas[i],
+					QueuePosition: queuePosition,
+				})
+				if len(page.Videos) == filter.Limit {
+					page.NextCursor = strconv.Itoa(queuePosition)
+					return page, nil
+				}
+			}
+		}
+		ahead += int(length)
+	}
+
+	return page, nil
+}
+
+// Events reads the event log list, which outlives the metadata of a video
+// only until the janitor or a cancellation removes both
+func (s *Redis) Events(ctx context.Context, uuid string) ([]structs.VideoEvent, error) {
+	pipe := s.rdb.Pipeline()
+	exists := pipe.Exists(ctx, metaKey(uuid))
+	entries := pipe.LRange(ctx, events.Key(uuid), 0, -1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	if exists.Val() == 0 && len(entries.Val()) == 0 {
+		return nil, nil
+	}
+
+	videoEvents := make([]structs.VideoEvent, 0, len(entries.Val()))
+	for _, entry := range entries.Val() {
+		var event structs.VideoEvent
+		if err := json.Unmarshal([]byte(entry), &event); err != nil {
+			log.Printf("Skipping malformed event for video %s: %v", uuid, err)
+			continue
+		}
+		videoEvents = append(videoEvents, event)
+	}
+	return videoEvents, nil
+}
@@ -0,0 +1,1163 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"firecast/pkg/events"
+	"firecast/pkg/structs"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlPollInterval is how often Wait looks for jobs queued by other processes
+// or scheduled jobs that became due
+const sqlPollInterval = time.Second
+
+// sqlMigrations are applied in order, each once, and recorded in schema_migrations.
+// Append new migrations, never change an applied one.
+var sqlMigrations = []string{
+	`
+CREATE TABLE jobs (
+	uuid TEXT PRIMARY KEY,
+	priority TEXT NOT NULL,
+	state TEXT NOT NULL,
+	-- queued_seq orders queued jobs within a priority, oldest first
+	queued_seq INTEGER NOT NULL DEFAULT 0,
+	not_before INTEGER NOT NULL DEFAULT 0,
+	lease_expires_at INTEGER NOT NULL DEFAULT 0,
+	url TEXT NOT NULL DEFAULT '',
+	playlist_id INTEGER NOT NULL DEFAULT 0,
+	added_at INTEGER NOT NULL,
+	finished_at INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT NOT NULL DEFAULT '',
+	-- meta is the JSON object of all metadata fields, as in videos:meta:<uuid>
+	meta TEXT NOT NULL
+);
+CREATE INDEX jobs_state ON jobs (state, priority, queued_seq);
+CREATE INDEX jobs_added_at ON jobs (added_at);
+
+CREATE TABLE job_index (
+	index_field TEXT PRIMARY KEY,
+	uuid TEXT NOT NULL
+);
+
+CREATE TABLE job_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	uuid TEXT NOT NULL,
+	type TEXT NOT NULL,
+	state TEXT NOT NULL DEFAULT '',
+	at INTEGER NOT NULL,
+	-- event is the JSON encoded structs.VideoEvent
+	event TEXT NOT NULL
+);
+CREATE INDEX job_events_uuid ON job_events (uuid, id);
+`,
+	`
+CREATE TABLE janitor (
+	id INTEGER PRIMARY KEY CHECK (id = 1),
+	last_run_at INTEGER NOT NULL DEFAULT 0,
+	done_pruned INTEGER NOT NULL DEFAULT 0,
+	fail_pruned INTEGER NOT NULL DEFAULT 0,
+	last_done_pruned INTEGER NOT NULL DEFAULT 0,
+	last_fail_pruned INTEGER NOT NULL DEFAULT 0
+);
+INSERT INTO janitor (id) VALUES (1);
+CREATE INDEX jobs_finished_at ON jobs (state, finished_at);
+`,
+}
+
+// stateCancelled marks jobs that were cancelled. They are kept for their
+// history but are otherwise treated as if they no longer existed.
+const stateCancelled = "cancelled"
+
+// SQL is a Store in a SQLite database. Unlike Redis it keeps cancelled jobs
+// and their events, so the history of everything submitted can be queried until
+// the janitor prunes it. Scheduled jobs are also promoted when a worker claims.
+// Events are published once the transition that recorded them is committed.
+type SQL struct {
+	db      *sql.DB
+	config  Config
+	publish events.Publisher
+
+	mu sync.Mutex
+	// wake is closed and replaced whenever this process queues a job
+	wake chan struct{}
+}
+
+// OpenSQLite opens or creates the database at path and brings its schema up to
+// date. publish may be nil if nothing subscribes to events.
+func OpenSQLite(ctx context.Context, path string, config Config, publish events.Publisher) (*SQL, error) {
+	// Every transaction takes the write lock up front, so the read-modify-write
+	// transitions below cannot interleave
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate", path))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	s := &SQL{db: db, config: config, publish: publish, wake: make(chan struct{})}
+	if err := s.migrate(ctx); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to migrate %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// Close closes the database
+func (s *SQL) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQL) migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx,
+		`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at INTEGER NOT NULL)`,
+	); err != nil {
+		return err
+	}
+
+	var version int
+	if err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+
+	for ; version < len(sqlMigrations); version++ {
+		err := s.inTx(ctx, func(tx *sqlTx) error {
+			if _, err := tx.ExecContext(ctx, sqlMigrations[version]); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx,
+				`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`,
+				version+1, time.Now().Unix(),
+			)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d: %v", version+1, err)
+		}
+	}
+	return nil
+}
+
+// sqlTx is a transaction that collects the events to publish once it commits
+type sqlTx struct {
+	*sql.Tx
+	events []structs.VideoEvent
+}
+
+func (s *SQL) inTx(ctx context.Context, fn func(tx *sqlTx) error) error {
+	dbTx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	tx := &sqlTx{Tx: dbTx}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if s.publish == nil {
+		return nil
+	}
+	for _, event := range tx.events {
+		if err := s.publish(ctx, event); err != nil {
+			log.Printf("Error publishing %s event of %s: %v", event.Type, event.Uuid, err)
+		}
+	}
+	return nil
+}
+
+// notify wakes every Wait in this process
+func (s *SQL) notify() {
+	s.mu.Lock()
+	close(s.wake)
+	s.wake = make(chan struct{})
+	s.mu.Unlock()
+}
+
+// sqlJob is the part of a jobs row the transitions work on
+type sqlJob struct {
+	uuid           string
+	priority       string
+	state          string
+	queuedSeq      int64
+	notBefore      int64
+	leaseExpiresAt int64
+	meta           map[string]string
+}
+
+// sqlQuerier is a database or a transaction
+type sqlQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// loadJob reads a job, or returns nil if it does not exist
+func loadJob(ctx context.Context, db sqlQuerier, uuid string) (*sqlJob, error) {
+	job := &sqlJob{uuid: uuid}
+	var metaJSON string
+	err := db.QueryRowContext(ctx,
+		`SELECT priority, state, queued_seq, not_before, lease_expires_at, meta FROM jobs WHERE uuid = ?`, uuid,
+	).Scan(&job.priority, &job.state, &job.queuedSeq, &job.notBefore, &job.leaseExpiresAt, &metaJSON)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(metaJSON), &job.meta); err != nil {
+		return nil, fmt.Errorf("invalid metadata of %s: %v", uuid, err)
+	}
+	return job, nil
+}
+
+// save writes the state and metadata of a job back, together with the columns
+// kept alongside the metadata for querying
+func (j *sqlJob) save(ctx context.Context, tx *sqlTx) error {
+	metaJSON, err := json.Marshal(j.meta)
+	if err != nil {
+		return err
+	}
+	finishedAt, _ := strconv.ParseInt(j.meta["finished_at"], 10, 64)
+	notBefore, _ := strconv.ParseInt(j.meta["not_before"], 10, 64)
+	_, err = tx.ExecContext(ctx,
+		`UPDATE jobs SET state = ?, lease_expires_at = ?, not_before = ?, finished_at = ?, last_error = ?, meta = ? WHERE uuid = ?`,
+		j.state, j.leaseExpiresAt, notBefore, finishedAt, j.meta["last_error"], string(metaJSON), j.uuid,
+	)
+	return err
+}
+
+// queue moves a job to the back of the queue of its priority
+func (j *sqlJob) queue(ctx context.Context, tx *sqlTx) error {
+	j.state = structs.StateQueued
+	if err := j.save(ctx, tx); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx,
+		`UPDATE jobs SET queued_seq = (SELECT COALESCE(MAX(queued_seq), 0) + 1 FROM jobs) WHERE uuid = ?`, j.uuid,
+	)
+	return err
+}
+
+// appendSQLEvent records an event in the event log of a job and publishes it
+func appendSQLEvent(ctx context.Context, tx *sqlTx, uuid string, event structs.VideoEvent) error {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO job_events (uuid, type, state, at, event) VALUES (?, ?, ?, ?, ?)`,
+		uuid, event.Type, event.State, event.At, string(eventJSON),
+	)
+	if err != nil {
+		return err
+	}
+	return tx.publish(ctx, uuid, event)
+}
+
+// publish queues an event for publishing after the commit and applies it to the
+// progress counters of the expand job that added the job, like publishEvent in
+// events.Lua
+func (tx *sqlTx) publish(ctx context.Context, uuid string, event structs.VideoEvent) error {
+	job, err := loadJob(ctx, tx, uuid)
+	if err != nil || job == nil {
+		return err
+	}
+
+	parent, err := loadJob(ctx, tx, job.meta["parent"])
+	if err != nil {
+		return err
+	}
+	if field, delta := progressField(event); field != "" && parent != nil && parent.state != stateCancelled {
+		count, _ := strconv.Atoi(parent.meta[field])
+		parent.meta[field] = strconv.Itoa(count + delta)
+		if err := parent.save(ctx, tx); err != nil {
+			return err
+		}
+	}
+
+	event.Uuid = uuid
+	event.PlaylistId, _ = strconv.Atoi(job.meta["playlist_id"])
+	tx.events = append(tx.events, event)
+	return nil
+}
+
+// cancel keeps a cancelled job for its history and frees its duplicate index entry
+func (j *sqlJob) cancel(ctx context.Context, tx *sqlTx, now int64) error {
+	j.state = stateCancelled
+	j.leaseExpiresAt = 0
+	if err := j.save(ctx, tx); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx,
+		`DELETE FROM job_index WHERE index_field = ? AND uuid = ?`,
+		j.meta["video_id"]+":"+j.meta["playlist_id"], j.uuid,
+	)
+	if err != nil {
+		return err
+	}
+	return appendSQLEvent(ctx, tx, j.uuid, structs.VideoEvent{Type: structs.EventCancelled, At: now})
+}
+
+// finishable loads an in-progress job and reports why it cannot finish, or ""
+// if it can. A cancelled job is dropped.
+func finishable(ctx context.Context, tx *sqlTx, uuid, token string, now int64) (*sqlJob, string, error) {
+	job, err := loadJob(ctx, tx, uuid)
+	if err != nil {
+		return nil, "", err
+	}
+	if job == nil || job.state == stateCancelled || job.meta["attempt_token"] != token {
+		return job, "stale", nil
+	}
+	if _, ok := job.meta["cancelled_at"]; ok {
+		return job, "cancelled", job.cancel(ctx, tx, now)
+	}
+	switch job.state {
+	case structs.StateDone, structs.StateFail:
+		return job, job.state, nil
+	case structs.StateWip:
+		return job, "", nil
+	}
+	return job, "not_wip", nil
+}
+
+// enqueueJob stores one job inside a transaction
+func enqueueJob(ctx context.Context, tx *sqlTx, job *Job, now int64) (EnqueueResult, error) {
+	if !job.Force {
+		var existing string
+		err := tx.QueryRowContext(ctx,
+			`SELECT job_index.uuid FROM job_index JOIN jobs ON jobs.uuid = job_index.uuid
+			WHERE job_index.index_field = ? AND jobs.state != ?`,
+			job.IndexField, stateCancelled,
+		).Scan(&existing)
+		if err == nil {
+			return EnqueueResult{Uuid: existing, Duplicate: true}, nil
+		}
+		if err != sql.ErrNoRows {
+			return EnqueueResult{}, err
+		}
+	}
+
+	meta := make(map[string]string, len(job.Meta)/2)
+	for j := 0; j+1 < len(job.Meta); j += 2 {
+		meta[fmt.Sprint(job.Meta[j])] = fmt.Sprint(job.Meta[j+1])
+	}
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return EnqueueResult{}, err
+	}
+	playlistId, _ := strconv.Atoi(meta["playlist_id"])
+
+	event := structs.VideoEvent{Type: structs.EventAdded, At: now, Priority: job.Priority}
+	state := structs.StateQueued
+	if job.NotBefore > 0 {
+		state = structs.StateScheduled
+		event.NotBefore = job.NotBefore
+	}
+	event.State = state
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO jobs (uuid, priority, state, queued_seq, not_before, url, playlist_id, added_at, meta)
+		VALUES (?, ?, ?, (SELECT COALESCE(MAX(queued_seq), 0) + 1 FROM jobs), ?, ?, ?, ?, ?)`,
+		job.Uuid, job.Priority, state, job.NotBefore, meta["url"], playlistId, now, string(metaJSON),
+	)
+	if err != nil {
+		return EnqueueResult{}, err
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO job_index (index_field, uuid) VALUES (?, ?)
+		ON CONFLICT (index_field) DO UPDATE SET uuid = excluded.uuid`,
+		job.IndexField, job.Uuid,
+	)
+	if err != nil {
+		return EnqueueResult{}, err
+	}
+	if err := appendSQLEvent(ctx, tx, job.Uuid, event); err != nil {
+		return EnqueueResult{}, err
+	}
+	return EnqueueResult{Uuid: job.Uuid}, nil
+}
+
+func (s *SQL) Enqueue(ctx context.Context, jobs []*Job, now time.Time) ([]EnqueueResult, error) {
+	results := make([]EnqueueResult, len(jobs))
+	queued := false
+	err := s.inTx(ctx, func(tx *sqlTx) error {
+		for i, job := range jobs {
+			var err error
+			if results[i], err = enqueueJob(ctx, tx, job, now.Unix()); err != nil {
+				return err
+			}
+			queued = queued || (job.NotBefore == 0 && !results[i].Duplicate)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if queued {
+		s.notify()
+	}
+	return results, nil
+}
+
+// priorityOrder sorts the highest priority first
+func priorityOrder() string {
+	var order strings.Builder
+	order.WriteString("CASE priority")
+	for i, priority := range structs.Priorities {
+		fmt.Fprintf(&order, " WHEN '%s' THEN %d", priority, i)
+	}
+	fmt.Fprintf(&order, " ELSE %d END", len(structs.Priorities))
+	return order.String()
+}
+
+// queryUuids returns the first column of every row of a query
+func queryUuids(ctx context.Context, db sqlQuerier, query string, args ...any) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var uuids []string
+	for rows.Next() {
+		var uuid string
+		if err := rows.Scan(&uuid); err != nil {
+			return nil, err
+		}
+		uuids = append(uuids, uuid)
+	}
+	return uuids, rows.Err()
+}
+
+// promoteDue queues the scheduled jobs that are due, in the order they became due
+func promoteDue(ctx context.Context, tx *sqlTx, now int64) (int, error) {
+	due, err := queryUuids(ctx, tx,
+		`SELECT uuid FROM jobs WHERE state = ? AND not_before <= ? ORDER BY not_before, uuid`,
+		structs.StateScheduled, now,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, uuid := range due {
+		job, err := loadJob(ctx, tx, uuid)
+		if err != nil {
+			return 0, err
+		}
+		if err := job.queue(ctx, tx); err != nil {
+			return 0, err
+		}
+		if err := appendSQLEvent(ctx, tx, uuid, structs.VideoEvent{Type: structs.EventPromoted, At: now, State: structs.StateQueued}); err != nil {
+			return 0, err
+		}
+	}
+	return len(due), nil
+}
+
+func (s *SQL) Claim(ctx context.Context, token, worker string, now time.Time) (*Claim, error) {
+	var claim *Claim
+	err := s.inTx(ctx, func(tx *sqlTx) error {
+		if _, err := promoteDue(ctx, tx, now.Unix()); err != nil {
+			return err
+		}
+
+		var uuid string
+		err := tx.QueryRowContext(ctx,
+			`SELECT uuid FROM jobs WHERE state = ? ORDER BY `+priorityOrder()+`, queued_seq LIMIT 1`,
+			structs.StateQueued,
+		).Scan(&uuid)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		job, err := loadJob(ctx, tx, uuid)
+		if err != nil {
+			return err
+		}
+		retries, _ := strconv.Atoi(job.meta["retries"])
+		job.meta["retries"] = strconv.Itoa(retries + 1)
+		job.meta["attempt_token"] = token
+		job.meta["claimed_at"] = strconv.FormatInt(now.Unix(), 10)
+		job.meta["worker"] = worker
+		job.state = structs.StateWip
+		job.leaseExpiresAt = now.Add(s.config.LeaseDuration).Unix()
+		if err := job.save(ctx, tx); err != nil {
+			return err
+		}
+		err = appendSQLEvent(ctx, tx, uuid, structs.VideoEvent{
+			Type:    structs.EventClaimed,
+			At:      now.Unix(),
+			State:   structs.StateWip,
+			Worker:  worker,
+			Attempt: retries + 1,
+		})
+		if err != nil {
+			return err
+		}
+
+		claim = &Claim{Uuid: uuid, Meta: job.meta, LeaseExpiresAt: job.leaseExpiresAt}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claim, nil
+}
+
+// Wait returns when this process queues a job, and otherwise polls every
+// sqlPollInterval for jobs queued elsewhere or scheduled jobs that became due
+func (s *SQL) Wait(ctx context.Context, timeout time.Duration) error {
+	s.mu.Lock()
+	wake := s.wake
+	s.mu.Unlock()
+
+	timer := time.NewTimer(min(timeout, sqlPollInterval))
+	defer timer.Stop()
+	select {
+	case <-wake:
+	case <-timer.C:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (s *SQL) Heartbeat(ctx context.Context, uuid, token, stage string, now time.Time) (string, int64, error) {
+	leaseDeadline := now.Add(s.config.LeaseDuration).Unix()
+	status := "ok"
+	err := s.inTx(ctx, func(tx *sqlTx) error {
+		job, err := loadJob(ctx, tx, uuid)
+		if err != nil {
+			return err
+		}
+		switch {
+		case job == nil || job.state == stateCancelled || job.meta["attempt_token"] != token:
+			status = "stale"
+		case job.meta["cancelled_at"] != "":
+			status = "cancelled"
+		case job.state != structs.StateWip:
+			status = "not_wip"
+		default:
+			job.leaseExpiresAt = leaseDeadline
+			if err := job.save(ctx, tx); err != nil {
+				return err
+			}
+			if stage == "" {
+				return nil
+			}
+			return tx.publish(ctx, uuid, structs.VideoEvent{Type: structs.EventProgress, At: now.Unix(), State: structs.StateWip, Stage: stage})
+		}
+		return nil
+	})
+	return status, leaseDeadline, err
+}
+
+func (s *SQL) Complete(ctx context.Context, uuid, token string, now time.Time) (string, error) {
+	status := "ok"
+	err := s.inTx(ctx, func(tx *sqlTx) error {
+		job, reason, err := finishable(ctx, tx, uuid, token, now.Unix())
+		if err != nil || reason != "" {
+			status = reason
+			return err
+		}
+
+		job.state = structs.StateDone
+		job.leaseExpiresAt = 0
+		job.meta["finished_at"] = strconv.FormatInt(now.Unix(), 10)
+		if err := job.save(ctx, tx); err != nil {
+			return err
+		}
+		return appendSQLEvent(ctx, tx, uuid, structs.VideoEvent{Type: structs.EventDone, At: now.Unix(), State: structs.StateDone})
+	})
+	return status, err
+}
+
+func (s *SQL) Fail(ctx context.Context, uuid, token string, failure Failure, now time.Time) (string, int64, error) {
+	status := "ok"
+	var nextAttemptAt int64
+	err := s.inTx(ctx, func(tx *sqlTx) error {
+		job, reason, err := finishable(ctx, tx, uuid, token, now.Unix())
+		if err != nil || reason != "" {
+			status = reason
+			return err
+		}
+
+		retries, _ := strconv.Atoi(job.meta["retries"])
+		var retry bool
+		retry, nextAttemptAt = s.config.retryAt(retries, failure.Class, now)
+
+		job.meta["last_error"] = failure.Error
+		job.meta["last_error_stage"] = failure.Stage
+		job.meta["last_error_class"] = failure.Class
+		job.meta["last_error_at"] = strconv.FormatInt(now.Unix(), 10)
+		event := structs.VideoEvent{
+			Type:  structs.EventFailed,
+			At:    now.Unix(),
+			Error: failure.Error,
+			Stage: failure.Stage,
+			Class: failure.Class,
+		}
+
+		if retry {
+			event.Type = structs.EventAttemptFailed
+			status, err = s.retryLater(ctx, tx, job, now.Unix(), nextAttemptAt)
+		} else {
+			job.state = structs.StateFail
+			job.leaseExpiresAt = 0
+			job.meta["finished_at"] = strconv.FormatInt(now.Unix(), 10)
+			err = job.save(ctx, tx)
+		}
+		if err != nil {
+			return err
+		}
+
+		event.State = job.state
+		if job.state == structs.StateScheduled {
+			event.NotBefore = nextAttemptAt
+		}
+		return appendSQLEvent(ctx, tx, uuid, event)
+	})
+	if status == "queue" {
+		s.notify()
+	}
+	return status, nextAttemptAt, err
+}
+
+// retryLater takes a job out of the wip state and queues it, or schedules it
+// if its next attempt is in the future
+func (s *SQL) retryLater(ctx context.Context, tx *sqlTx, job *sqlJob, now, nextAttemptAt int64) (string, error) {
+	delete(job.meta, "attempt_token")
+	job.leaseExpiresAt = 0
+	job.meta["last_attempt_at"] = strconv.FormatInt(now, 10)
+	job.meta["not_before"] = strconv.FormatInt(nextAttemptAt, 10)
+	if nextAttemptAt > now {
+		job.state = structs.StateScheduled
+		return "scheduled", job.save(ctx, tx)
+	}
+	return "queue", job.queue(ctx, tx)
+}
+
+func (s *SQL) Recover(ctx context.Context, now time.Time) ([]Recovery, error) {
+	var recovered []Recovery
+	err := s.inTx(ctx, func(tx *sqlTx) error {
+		expired, err := queryUuids(ctx, tx,
+			`SELECT uuid FROM jobs WHERE state = ? AND lease_expires_at <= ? ORDER BY lease_expires_at, uuid`,
+			structs.StateWip, now.Unix(),
+		)
+		if err != nil {
+			return err
+		}
+
+		for _, uuid := range expired {
+			job, err := loadJob(ctx, tx, uuid)
+			if err != nil {
+				return err
+			}
+			retries, _ := strconv.Atoi(job.meta["retries"])
+			nextAttemptAt := s.config.RetryPolicy.NextAttemptAt(now, retries).Unix()
+			recovery := Recovery{Uuid: uuid, NotBefore: nextAttemptAt}
+			event := structs.VideoEvent{Type: structs.EventTimedOut, At: now.Unix()}
+
+			switch {
+			case job.meta["cancelled_at"] != "":
+				recovery.Status = "cancelled"
+				err = job.cancel(ctx, tx, now.Unix())
+			case retries >= s.config.MaxRetries:
+				recovery.Status = "fail"
+				event.Type, event.Error = structs.EventFailed, leaseExpiredError
+				delete(job.meta, "attempt_token")
+				job.state = structs.StateFail
+				job.leaseExpiresAt = 0
+				job.meta["finished_at"] = strconv.FormatInt(now.Unix(), 10)
+				err = job.save(ctx, tx)
+			default:
+				recovery.Status, err = s.retryLater(ctx, tx, job, now.Unix(), nextAttemptAt)
+			}
+			if err != nil {
+				return err
+			}
+
+			if recovery.Status != "cancelled" {
+				event.State = job.state
+				if job.state == structs.StateScheduled {
+					event.NotBefore = nextAttemptAt
+				}
+				if err := appendSQLEvent(ctx, tx, uuid, event); err != nil {
+					return err
+				}
+			}
+			recovered = append(recovered, recovery)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, recovery := range recovered {
+		if recovery.Status == "queue" {
+			s.notify()
+			break
+		}
+	}
+	return recovered, nil
+}
+
+func (s *SQL) State(ctx context.Context, uuid string) (string, error) {
+	var state string
+	err := s.db.QueryRowContext(ctx, `SELECT state FROM jobs WHERE uuid = ?`, uuid).Scan(&state)
+	if err == sql.ErrNoRows || state == stateCancelled {
+		return structs.StateUnknown, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return state, nil
+}
+
+func (s *SQL) Stats(ctx context.Context) (*Stats, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT state, priority, COUNT(*) FROM jobs GROUP BY state, priority`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	stats := &Stats{QueueByPriority: make(map[string]int, len(structs.Priorities))}
+	for _, priority := range structs.Priorities {
+		stats.QueueByPriority[priority] = 0
+	}
+	for rows.Next() {
+		var state, priority string
+		var count int
+		if err := rows.Scan(&state, &priority, &count); err != nil {
+			return nil, err
+		}
+		switch state {
+		case structs.StateQueued:
+			stats.QueueByPriority[priority] += count
+		case structs.StateScheduled:
+			stats.Scheduled += count
+		case structs.StateWip:
+			stats.Wip += count
+		case structs.StateDone:
+			stats.Done += count
+		case structs.StateFail:
+			stats.Fail += count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	err = s.db.QueryRowContext(ctx,
+		`SELECT last_run_at, done_pruned, fail_pruned, last_done_pruned, last_fail_pruned FROM janitor`,
+	).Scan(
+		&stats.Janitor.LastRunAt,
+		&stats.Janitor.DonePruned,
+		&stats.Janitor.FailPruned,
+		&stats.Janitor.LastDonePruned,
+		&stats.Janitor.LastFailPruned,
+	)
+	return stats, err
+}
+
+func (s *SQL) Expand(ctx context.Context, uuid, token string, children []*Job, now time.Time) (string, []EnqueueResult, error) {
+	status := "ok"
+	var results []EnqueueResult
+	created := 0
+	err := s.inTx(ctx, func(tx *sqlTx) error {
+		job, reason, err := finishable(ctx, tx, uuid, token, now.Unix())
+		if err != nil || reason != "" {
+			status = reason
+			return err
+		}
+
+		results = make([]EnqueueResult, len(children))
+		duplicates := 0
+		for i, child := range children {
+			childJob := *child
+			childJob.Meta = append(slices.Clip(child.Meta), "parent", uuid)
+			if results[i], err = enqueueJob(ctx, tx, &childJob, now.Unix()); err != nil {
+				return err
+			}
+			if results[i].Duplicate {
+				duplicates++
+			} else {
+				created++
+			}
+		}
+
+		job.state = structs.StateDone
+		job.leaseExpiresAt = 0
+		job.meta["finished_at"] = strconv.FormatInt(now.Unix(), 10)
+		job.meta["children_total"] = strconv.Itoa(created)
+		job.meta["children_duplicate"] = strconv.Itoa(duplicates)
+		job.meta["children_done"] = "0"
+		job.meta["children_failed"] = "0"
+		job.meta["children_cancelled"] = "0"
+		if err := job.save(ctx, tx); err != nil {
+			return err
+		}
+		return appendSQLEvent(ctx, tx, uuid, structs.VideoEvent{
+			Type:       structs.EventExpanded,
+			At:         now.Unix(),
+			State:      structs.StateDone,
+			Children:   created,
+			Duplicates: duplicates,
+		})
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if created > 0 {
+		s.notify()
+	}
+	return status, results, nil
+}
+
+func (s *SQL) Cancel(ctx context.Context, uuid string, now time.Time) (string, error) {
+	var status string
+	err := s.inTx(ctx, func(tx *sqlTx) error {
+		job, err := loadJob(ctx, tx, uuid)
+		if err != nil {
+			return err
+		}
+		switch {
+		case job == nil || job.state == stateCancelled:
+			status = "missing"
+		case job.state == structs.StateWip:
+			status = "cancelling"
+			job.meta["cancelled_at"] = strconv.FormatInt(now.Unix(), 10)
+			if err := job.save(ctx, tx); err != nil {
+				return err
+			}
+			return appendSQLEvent(ctx, tx, uuid, structs.VideoEvent{Type: structs.EventCancelRequested, At: now.Unix(), State: structs.StateWip})
+		case job.state == structs.StateDone || job.state == structs.StateFail:
+			status = "finished"
+		default:
+			status = "deleted"
+			return job.cancel(ctx, tx, now.Unix())
+		}
+		return nil
+	})
+	return status, err
+}
+
+func (s *SQL) Retry(ctx context.Context, uuid string, resetRetries bool, now time.Time) (string, error) {
+	status := "ok"
+	err := s.inTx(ctx, func(tx *sqlTx) error {
+		job, err := loadJob(ctx, tx, uuid)
+		if err != nil {
+			return err
+		}
+		if job == nil || job.state == stateCancelled {
+			status = "missing"
+			return nil
+		}
+		if job.state != structs.StateFail {
+			status = "not_failed"
+			return nil
+		}
+
+		delete(job.meta, "finished_at")
+		delete(job.meta, "attempt_token")
+		job.meta["last_attempt_at"] = strconv.FormatInt(now.Unix(), 10)
+		job.meta["not_before"] = "0"
+		if resetRetries {
+			job.meta["retries"] = "0"
+		}
+		if err := job.queue(ctx, tx); err != nil {
+			return err
+		}
+		return appendSQLEvent(ctx, tx, uuid, structs.VideoEvent{Type: structs.EventRetried, At: now.Unix(), State: structs.StateQueued})
+	})
+	if status == "ok" && err == nil {
+		s.notify()
+	}
+	return status, err
+}
+
+func (s *SQL) Promote(ctx context.Context, now time.Time) (int, error) {
+	var promoted int
+	err := s.inTx(ctx, func(tx *sqlTx) error {
+		var err error
+		promoted, err = promoteDue(ctx, tx, now.Unix())
+		return err
+	})
+	if promoted > 0 {
+		s.notify()
+	}
+	return promoted, err
+}
+
+// Prune deletes the jobs together with their events and index entries, and
+// keeps its counts in the janitor table
+func (s *SQL) Prune(ctx context.Context, cutoffs map[string]int64, now time.Time) (map[string]int, error) {
+	pruned := make(map[string]int, len(cutoffs))
+	err := s.inTx(ctx, func(tx *sqlTx) error {
+		for _, state := range []string{structs.StateDone, structs.StateFail} {
+			cutoff, ok := cutoffs[state]
+			if !ok {
+				continue
+			}
+			uuids, err := queryUuids(ctx, tx, `SELECT uuid FROM jobs WHERE state = ? AND finished_at <= ?`, state, cutoff)
+			if err != nil {
+				return err
+			}
+			for _, uuid := range uuids {
+				for _, query := range []string{
+					`DELETE FROM job_index WHERE uuid = ?`,
+					`DELETE FROM job_events WHERE uuid = ?`,
+					`DELETE FROM jobs WHERE uuid = ?`,
+				} {
+					if _, err := tx.ExecContext(ctx, query, uuid); err != nil {
+						return err
+					}
+				}
+			}
+			pruned[state] = len(uuids)
+		}
+
+		_, doneSet := cutoffs[structs.StateDone]
+		_, failSet := cutoffs[structs.StateFail]
+		_, err := tx.ExecContext(ctx,
+			`UPDATE janitor SET last_run_at = ?,
+				done_pruned = done_pruned + ?,
+				fail_pruned = fail_pruned + ?,
+				last_done_pruned = CASE WHEN ? THEN ? ELSE last_done_pruned END,
+				last_fail_pruned = CASE WHEN ? THEN ? ELSE last_fail_pruned END`,
+			now.Unix(),
+			pruned[structs.StateDone], pruned[structs.StateFail],
+			doneSet, pruned[structs.StateDone],
+			failSet, pruned[structs.StateFail],
+		)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pruned, nil
+}
+
+// video describes a loaded job the way Lookup and List return it
+func (s *SQL) video(ctx context.Context, job *sqlJob) (*Video, error) {
+	video := &Video{Uuid: job.uuid, State: job.state, Meta: job.meta}
+	switch job.state {
+	case structs.StateWip:
+		video.LeaseExpiresAt = job.leaseExpiresAt
+	case structs.StateScheduled:
+		video.NotBefore = job.notBefore
+	case structs.StateQueued:
+		rank := slices.Index(structs.Priorities, job.priority)
+		if rank < 0 {
+			rank = len(structs.Priorities)
+		}
+		err := s.db.QueryRowContext(ctx,
+			`SELECT COUNT(*) FROM jobs WHERE state = ?
+			AND (`+priorityOrder()+` < ? OR (`+priorityOrder()+` = ? AND queued_seq <= ?))`,
+			structs.StateQueued, rank, rank, job.queuedSeq,
+		).Scan(&video.QueuePosition)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return video, nil
+}
+
+func (s *SQL) Lookup(ctx context.Context, uuid string) (*Video, error) {
+	job, err := loadJob(ctx, s.db, uuid)
+	if err != nil || job == nil || job.state == stateCancelled {
+		return nil, err
+	}
+	return s.video(ctx, job)
+}
+
+// sqlScoreColumns order the jobs of every state but queued like the Redis sorted sets
+var sqlScoreColumns = map[string]string{
+	structs.StateScheduled: "not_before",
+	structs.StateWip:       "lease_expires_at",
+	structs.StateDone:      "finished_at",
+	structs.StateFail:      "finished_at",
+}
+
+// List pages with the same cursors as Redis: the queue position of the last
+// returned queued job, or the score and uuid of the last returned job otherwise
+func (s *SQL) List(ctx context.Context, state string, filter ListFilter) (*Page, error) {
+	page := &Page{Videos: []*Video{}}
+
+	if state == structs.StateQueued {
+		position := 0
+		if filter.Cursor != "" {
+			var err error
+			position, err = strconv.Atoi(filter.Cursor)
+			if err != nil || position < 0 {
+				return nil, ErrInvalidCursor
+			}
+		}
+		for offset := position; ; offset += filter.Limit {
+			uuids, err := queryUuids(ctx, s.db,
+				`SELECT uuid FROM jobs WHERE state = ? ORDER BY `+priorityOrder()+`, queued_seq LIMIT ? OFFSET ?`,
+				structs.StateQueued, filter.Limit, offset,
+			)
+			if err != nil {
+				return nil, err
+			}
+			for i, uuid := range uuids {
+				job, err := loadJob(ctx, s.db, uuid)
+				if err != nil {
+					return nil, err
+				}
+				if job == nil || !filter.matches(job.meta, state, true) {
+					continue
+				}
+				page.Videos = append(page.Videos, &Video{
+					Uuid:          uuid,
+					State:         state,
+					Meta:          job.meta,
+					QueuePosition: offset + i + 1,
+				})
+				if len(page.Videos) == filter.Limit {
+					page.NextCursor = strconv.Itoa(offset + i + 1)
+					return page, nil
+				}
+			}
+			if len(uuids) < filter.Limit {
+				return page, nil
+			}
+		}
+	}
+
+	scoreColumn, ok := sqlScoreColumns[state]
+	if !ok {
+		return page, nil
+	}
+	afterScore := int64(math.MinInt64)
+	afterUuid := ""
+	if filter.Cursor != "" {
+		scoreStr, videoUuid, found := strings.Cut(filter.Cursor, ":")
+		score, err := strconv.ParseInt(scoreStr, 10, 64)
+		if !found || err != nil {
+			return nil, ErrInvalidCursor
+		}
+		afterScore, afterUuid = score, videoUuid
+	}
+	// The score is the time From and To apply to in every state but wip
+	scoreIsTime := state != structs.StateWip
+	minScore, maxScore := int64(math.MinInt64), int64(math.MaxInt64)
+	if scoreIsTime && filter.From != 0 {
+		minScore = filter.From
+	}
+	if scoreIsTime && filter.To != 0 {
+		maxScore = filter.To
+	}
+
+	for {
+		rows, err := s.db.QueryContext(ctx,
+			`SELECT uuid, `+scoreColumn+` FROM jobs
+			WHERE state = ? AND `+scoreColumn+` BETWEEN ? AND ?
+			AND (`+scoreColumn+` > ? OR (`+scoreColumn+` = ? AND uuid > ?))
+			AND (? = 0 OR playlist_id = ?)
+			ORDER BY `+scoreColumn+`, uuid LIMIT ?`,
+			state, minScore, maxScore,
+			afterScore, afterScore, afterUuid,
+			filter.PlaylistId, filter.PlaylistId,
+			filter.Limit,
+		)
+		if err != nil {
+			return nil, err
+		}
+		type scored struct {
+			uuid  string
+			score int64
+		}
+		var batch []scored
+		for rows.Next() {
+			var entry scored
+			if err := rows.Scan(&entry.uuid, &entry.score); err != nil {
+				_ = rows.Close()
+				return nil, err
+			}
+			batch = append(batch, entry)
+		}
+		if err := rows.Close(); err != nil {
+			return nil, err
+		}
+
+		for _, entry := range batch {
+			afterScore, afterUuid = entry.score, entry.uuid
+			job, err := loadJob(ctx, s.db, entry.uuid)
+			if err != nil {
+				return nil, err
+			}
+			if job == nil || !filter.matches(job.meta, state, !scoreIsTime) {
+				continue
+			}
+			video, err := s.video(ctx, job)
+			if err != nil {
+				return nil, err
+			}
+			page.Videos = append(page.Videos, video)
+			if len(page.Videos) == filter.Limit {
+				page.NextCursor = fmt.Sprintf("%d:%s", entry.score, entry.uuid)
+				return page, nil
+			}
+		}
+		if len(batch) < filter.Limit {
+			return page, nil
+		}
+	}
+}
+
+// Events also returns the history of cancelled jobs, which Redis deletes
+func (s *SQL) Events(ctx context.Context, uuid string) ([]structs.VideoEvent, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT event FROM job_events WHERE uuid = ? ORDER BY id`, uuid)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var videoEvents []structs.VideoEvent
+	for rows.Next() {
+		var eventJSON string
+		if err := rows.Scan(&eventJSON); err != nil {
+			return nil, err
+		}
+		var event structs.VideoEvent
+		if err := json.Unmarshal([]byte(eventJSON), &event); err != nil {
+			return nil, fmt.Errorf("invalid event of %s: %v", uuid, err)
+		}
+		videoEvents = append(videoEvents, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if videoEvents != nil {
+		return videoEvents, nil
+	}
+
+	job, err := loadJob(ctx, s.db, uuid)
+	if err != nil || job == nil {
+		return nil, err
+	}
+	return []structs.VideoEvent{}, nil
+}
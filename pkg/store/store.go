@@ -0,0 +1,238 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"firecast/pkg/backoff"
+	"firecast/pkg/structs"
+)
+
+// leaseExpiredError is the error of the failed event of a job whose last
+// attempt timed out
+const leaseExpiredError = "Worker lease expired"
+
+// Store holds the video jobs and moves them between the queue, scheduled,
+// wip, done and fail states. Every method is one atomic transition.
+//
+// Transitions on an in-progress job return a status instead of an error when
+// the job cannot make them: "stale" if the token does not belong to the current
+// attempt, "done" or "fail" if the job already finished, "not_wip" if its
+// lease was lost, or "cancelled" if it was cancelled and the worker should stop.
+type Store interface {
+	// Enqueue stores new jobs in order, all in one transaction. A job that
+	// duplicates an existing one in the same playlist is not stored unless it
+	// is forced, and its result carries the uuid of the existing job instead.
+	Enqueue(ctx context.Context, jobs []*Job, now time.Time) ([]EnqueueResult, error)
+	// Claim leases the oldest job of the highest non-empty priority to a worker.
+	// It returns nil if there is nothing to claim.
+	Claim(ctx context.Context, token, worker string, now time.Time) (*Claim, error)
+	// Wait blocks until a job may have become claimable, the timeout passes or
+	// the context is done. Redis wakes up as soon as a job is queued, SQL only
+	// notices jobs queued by other processes or becoming due on its next poll,
+	// every second.
+	Wait(ctx context.Context, timeout time.Duration) error
+	// Heartbeat extends the lease of an in-progress job and reports the stage
+	// its worker is in, which may be empty. It returns "ok" and the new lease deadline.
+	Heartbeat(ctx context.Context, uuid, token, stage string, now time.Time) (string, int64, error)
+	// Complete moves an in-progress job into the done state and returns "ok"
+	Complete(ctx context.Context, uuid, token string, now time.Time) (string, error)
+	// Fail records why an in-progress job failed. Transient failures are retried
+	// until MaxRetries is reached, returning "queue" or "scheduled" and the time
+	// of the next attempt. Otherwise the job moves into the fail state and "ok"
+	// is returned.
+	Fail(ctx context.Context, uuid, token string, failure Failure, now time.Time) (string, int64, error)
+	// Recover takes the jobs whose lease expired away from their workers
+	Recover(ctx context.Context, now time.Time) ([]Recovery, error)
+	// Expand completes an in-progress expand job by storing its children like
+	// Enqueue, each with a parent field pointing back at the expand job. It
+	// returns "ok" and the result of every child, or the same statuses as Complete.
+	Expand(ctx context.Context, uuid, token string, children []*Job, now time.Time) (string, []EnqueueResult, error)
+	// Cancel deletes a queued or scheduled job, or flags an in-progress one so
+	// its worker stops on its next heartbeat or report. It returns "deleted",
+	// "cancelling", "finished" or "missing".
+	Cancel(ctx context.Context, uuid string, now time.Time) (string, error)
+	// Retry moves a failed job back into its queue and returns "ok", "missing"
+	// if there is no such job, or "not_failed" if it did not fail
+	Retry(ctx context.Context, uuid string, resetRetries bool, now time.Time) (string, error)
+	// Promote queues the scheduled jobs that are due, in due order, and returns
+	// how many it queued
+	Promote(ctx context.Context, now time.Time) (int, error)
+	// Prune removes the jobs of each state in cutoffs that finished at or before
+	// its cutoff, records the run in Stats.Janitor and returns the counts per state
+	Prune(ctx context.Context, cutoffs map[string]int64, now time.Time) (map[string]int, error)
+	// State returns which of the structs.State* states a job is in
+	State(ctx context.Context, uuid string) (string, error)
+	// Lookup returns a job with its metadata and state, or nil if it does not exist
+	Lookup(ctx context.Context, uuid string) (*Video, error)
+	// List pages through the jobs in one state, queued jobs in the order they
+	// will be claimed and the others by due time, lease deadline or finish time
+	List(ctx context.Context, state string, filter ListFilter) (*Page, error)
+	// Events returns the event log of a job, oldest first, or nil if the job is unknown
+	Events(ctx context.Context, uuid string) ([]structs.VideoEvent, error)
+	// Stats counts the jobs in each state
+	Stats(ctx context.Context) (*Stats, error)
+}
+
+// ErrInvalidCursor is returned by List for a cursor it did not hand out
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Config holds the lease and retry settings a store applies to every job
+type Config struct {
+	// LeaseDuration is how long a worker may hold a job without a heartbeat
+	LeaseDuration time.Duration
+	// MaxRetries is how many attempts a job gets before it fails for good
+	MaxRetries  int
+	RetryPolicy backoff.Policy
+}
+
+// Job is a validated video, ready to be stored
+type Job struct {
+	Uuid     string
+	Priority string
+	// IndexField is the duplicate detection key, the media id and playlist id
+	IndexField string
+	Force      bool
+	// NotBefore schedules the job instead of queueing it, 0 queues it right away
+	NotBefore int64
+	// Meta holds the metadata as field/value pairs
+	Meta []interface{}
+}
+
+// EnqueueResult is the outcome of storing one job
+type EnqueueResult struct {
+	Uuid      string
+	Duplicate bool
+}
+
+// Claim is a job leased to a worker. Meta is nil if the job had no metadata,
+// in which case it was moved into the fail state instead.
+type Claim struct {
+	Uuid           string
+	Meta           map[string]string
+	LeaseExpiresAt int64
+}
+
+// Failure is what a worker reported about a failed attempt
+type Failure struct {
+	Error string
+	Stage string
+	Class string
+}
+
+// Recovery is what Recover did with one job whose lease expired: "queue",
+// "scheduled", "fail" once it used up its retries, or "cancelled" if it was
+// dropped because it had been cancelled
+type Recovery struct {
+	Uuid      string
+	Status    string
+	NotBefore int64
+}
+
+// Video is a job and where it currently sits. QueuePosition counts from 1 for
+// the next job to be claimed, LeaseExpiresAt is set in the wip state and
+// NotBefore in the scheduled state.
+type Video struct {
+	Uuid           string
+	State          string
+	Meta           map[string]string
+	QueuePosition  int
+	LeaseExpiresAt int64
+	NotBefore      int64
+}
+
+// ListFilter holds the paging and filter parameters of List. From and To apply
+// to the time a job was added, is due, was claimed or finished, depending on
+// its state.
+type ListFilter struct {
+	Cursor     string
+	Limit      int
+	PlaylistId int
+	Class      string
+	From       int64
+	To         int64
+}
+
+// Page is one page of List. NextCursor is empty on the last page.
+type Page struct {
+	Videos     []*Video
+	NextCursor string
+}
+
+// listTimeFields are the metadata fields From and To apply to in each state
+var listTimeFields = map[string]string{
+	structs.StateQueued:    "added_at",
+	structs.StateScheduled: "not_before",
+	structs.StateWip:       "claimed_at",
+	structs.StateDone:      "finished_at",
+	structs.StateFail:      "finished_at",
+}
+
+// matches reports whether a job's metadata passes the playlist and failure
+// class filters, and the time filter if checkTime is set
+func (f ListFilter) matches(meta map[string]string, state string, checkTime bool) bool {
+	if f.PlaylistId != 0 && meta["playlist_id"] != strconv.Itoa(f.PlaylistId) {
+		return false
+	}
+	if f.Class != "" && meta["last_error_class"] != f.Class {
+		return false
+	}
+	if checkTime && (f.From != 0 || f.To != 0) {
+		at, err := strconv.ParseInt(meta[listTimeFields[state]], 10, 64)
+		if err != nil || !f.inRange(at) {
+			return false
+		}
+	}
+	return true
+}
+
+// inRange reports whether a time passes the From and To filters
+func (f ListFilter) inRange(at int64) bool {
+	return (f.From == 0 || at >= f.From) && (f.To == 0 || at <= f.To)
+}
+
+// Stats are the job counts per state
+type Stats struct {
+	QueueByPriority map[string]int
+	Scheduled       int
+	Wip             int
+	Done            int
+	Fail            int
+	Janitor         structs.JanitorStatus
+}
+
+// progressField returns the progress counter of the parent expand job that an
+// event of one of its children changes, and by how much, or "" if it changes
+// none. It mirrors updateParent in events.Lua.
+func progressField(event structs.VideoEvent) (string, int) {
+	switch {
+	case event.Type == structs.EventRetried:
+		return "children_failed", -1
+	case event.Type == structs.EventCancelled:
+		return "children_cancelled", 1
+	case event.State == structs.StateDone:
+		return "children_done", 1
+	case event.State == structs.StateFail:
+		return "children_failed", 1
+	}
+	return "", 0
+}
+
+// retryAt decides whether a failed attempt is retried and when. Only transient
+// failures are retried, and only until the retries run out.
+func (c Config) retryAt(retries int, class string, now time.Time) (bool, int64) {
+	retry := class == structs.ClassTransient && retries < c.MaxRetries
+	return retry, c.RetryPolicy.NextAttemptAt(now, retries).Unix()
+}
+
+// nextAttempts lists when a failed job becomes eligible again after 1, 2, ...
+// MaxRetries attempts, for scripts that decide on the retry counter themselves
+func (c Config) nextAttempts(now time.Time) []interface{} {
+	attempts := make([]interface{}, c.MaxRetries)
+	for i := range attempts {
+		attempts[i] = c.RetryPolicy.NextAttemptAt(now, i+1).Unix()
+	}
+	return attempts
+}
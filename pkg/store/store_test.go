@@ -0,0 +1,532 @@
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"firecast/pkg/backoff"
+	"firecast/pkg/events"
+	"firecast/pkg/structs"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+var testNow = time.Unix(1_700_000_000, 0)
+
+// testStores opens an empty store of every kind, so each test checks that they
+// agree on the same transitions and status strings
+var testStores = map[string]func(t *testing.T, config Config) Store{
+	"memory": func(t *testing.T, config Config) Store {
+		return NewMemory(config, nil)
+	},
+	"sqlite": func(t *testing.T, config Config) Store {
+		s, err := OpenSQLite(context.Background(), filepath.Join(t.TempDir(), "jobs.db"), config, nil)
+		if err != nil {
+			t.Fatalf("OpenSQLite: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = s.Close()
+		})
+		return s
+	},
+	"redis": func(t *testing.T, config Config) Store {
+		rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+		s := NewRedis(rdb, config)
+		t.Cleanup(func() {
+			_ = s.Close()
+			_ = rdb.Close()
+		})
+		return s
+	},
+}
+
+func forEachStore(t *testing.T, config Config, test func(t *testing.T, s Store)) {
+	for name, open := range testStores {
+		t.Run(name, func(t *testing.T) {
+			test(t, open(t, config))
+		})
+	}
+}
+
+// testJob returns a job for the video and playlist in index, e.g. "abc:1"
+func testJob(uuid, priority, index string) *Job {
+	videoId, playlistId, _ := strings.Cut(index, ":")
+	return &Job{
+		Uuid:       uuid,
+		Priority:   priority,
+		IndexField: index,
+		Meta: []interface{}{
+			"type", structs.JobTypeVideo,
+			"video_id", videoId,
+			"playlist_id", playlistId,
+			"priority", priority,
+			"retries", 0,
+			"added_at", testNow.Unix(),
+		},
+	}
+}
+
+func enqueue(t *testing.T, s Store, jobs ...*Job) []EnqueueResult {
+	t.Helper()
+	results, err := s.Enqueue(context.Background(), jobs, testNow)
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	return results
+}
+
+func claim(t *testing.T, s Store, token string, now time.Time) string {
+	t.Helper()
+	claimed, err := s.Claim(context.Background(), token, "worker", now)
+	if err != nil {
+		t.Fatalf("Claim: %v", err)
+	}
+	if claimed == nil {
+		return ""
+	}
+	return claimed.Uuid
+}
+
+func expectStatus(t *testing.T, what, status string, err error, want string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %v", what, err)
+	}
+	if status != want {
+		t.Fatalf("%s = %q, want %q", what, status, want)
+	}
+}
+
+func expectState(t *testing.T, s Store, uuid, want string) {
+	t.Helper()
+	state, err := s.State(context.Background(), uuid)
+	expectStatus(t, "State("+uuid+")", state, err, want)
+}
+
+// expectLastEvent checks the type and state of the newest event of a job
+func expectLastEvent(t *testing.T, s Store, uuid, eventType, state string) {
+	t.Helper()
+	events, err := s.Events(context.Background(), uuid)
+	if err != nil {
+		t.Fatalf("Events(%s): %v", uuid, err)
+	}
+	if len(events) == 0 {
+		t.Fatalf("Events(%s) is empty", uuid)
+	}
+	last := events[len(events)-1]
+	if last.Type != eventType || last.State != state {
+		t.Fatalf("last event of %s = %s in %s, want %s in %s", uuid, last.Type, last.State, eventType, state)
+	}
+}
+
+var testConfig = Config{LeaseDuration: time.Minute, MaxRetries: 2}
+
+func TestEnqueueDuplicates(t *testing.T) {
+	forEachStore(t, testConfig, func(t *testing.T, s Store) {
+		results := enqueue(t, s,
+			testJob("a", structs.PriorityNormal, "v1:1"),
+			testJob("b", structs.PriorityNormal, "v1:1"),
+			testJob("c", structs.PriorityNormal, "v1:2"),
+		)
+		want := []EnqueueResult{{Uuid: "a"}, {Uuid: "a", Duplicate: true}, {Uuid: "c"}}
+		for i := range want {
+			if results[i] != want[i] {
+				t.Fatalf("result %d = %+v, want %+v", i, results[i], want[i])
+			}
+		}
+
+		forced := testJob("d", structs.PriorityNormal, "v1:1")
+		forced.Force = true
+		if results := enqueue(t, s, forced); results[0] != (EnqueueResult{Uuid: "d"}) {
+			t.Fatalf("forced result = %+v", results[0])
+		}
+		expectState(t, s, "b", structs.StateUnknown)
+		expectState(t, s, "d", structs.StateQueued)
+	})
+}
+
+func TestClaimOrder(t *testing.T) {
+	forEachStore(t, testConfig, func(t *testing.T, s Store) {
+		enqueue(t, s,
+			testJob("low", structs.PriorityLow, "v1:1"),
+			testJob("normal1", structs.PriorityNormal, "v2:1"),
+			testJob("high", structs.PriorityHigh, "v3:1"),
+			testJob("normal2", structs.PriorityNormal, "v4:1"),
+		)
+
+		video, err := s.Lookup(context.Background(), "low")
+		if err != nil || video == nil || video.QueuePosition != 4 {
+			t.Fatalf("Lookup(low) = %+v, %v, want queue position 4", video, err)
+		}
+
+		for _, want := range []string{"high", "normal1", "normal2", "low", ""} {
+			if got := claim(t, s, "token-"+want, testNow); got != want {
+				t.Fatalf("claimed %q, want %q", got, want)
+			}
+		}
+		expectState(t, s, "high", structs.StateWip)
+	})
+}
+
+func TestPromoteInDueOrder(t *testing.T) {
+	forEachStore(t, testConfig, func(t *testing.T, s Store) {
+		later := testJob("later", structs.PriorityNormal, "v1:1")
+		later.NotBefore = testNow.Unix() + 20
+		sooner := testJob("sooner", structs.PriorityNormal, "v2:1")
+		sooner.NotBefore = testNow.Unix() + 10
+		enqueue(t, s, later, sooner)
+		expectState(t, s, "later", structs.StateScheduled)
+
+		promoted, err := s.Promote(context.Background(), testNow.Add(30*time.Second))
+		if err != nil || promoted != 2 {
+			t.Fatalf("Promote = %d, %v, want 2", promoted, err)
+		}
+		for _, want := range []string{"sooner", "later"} {
+			if got := claim(t, s, "token", testNow.Add(30*time.Second)); got != want {
+				t.Fatalf("claimed %q, want %q", got, want)
+			}
+		}
+	})
+}
+
+func TestStaleTokens(t *testing.T) {
+	forEachStore(t, testConfig, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		enqueue(t, s, testJob("a", structs.PriorityNormal, "v1:1"))
+		claim(t, s, "right", testNow)
+
+		status, _, err := s.Heartbeat(ctx, "a", "wrong", "download", testNow)
+		expectStatus(t, "Heartbeat with a wrong token", status, err, "stale")
+		status, err = s.Complete(ctx, "a", "wrong", testNow)
+		expectStatus(t, "Complete with a wrong token", status, err, "stale")
+		status, _, err = s.Fail(ctx, "a", "wrong", Failure{Class: structs.ClassPermanent}, testNow)
+		expectStatus(t, "Fail with a wrong token", status, err, "stale")
+
+		status, _, err = s.Heartbeat(ctx, "a", "right", "download", testNow)
+		expectStatus(t, "Heartbeat", status, err, "ok")
+		status, err = s.Complete(ctx, "a", "right", testNow)
+		expectStatus(t, "Complete", status, err, "ok")
+		status, err = s.Complete(ctx, "a", "right", testNow)
+		expectStatus(t, "Complete twice", status, err, "done")
+		expectState(t, s, "a", structs.StateDone)
+	})
+}
+
+func TestFailures(t *testing.T) {
+	forEachStore(t, testConfig, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		transient := Failure{Error: "timeout", Stage: "download", Class: structs.ClassTransient}
+		enqueue(t, s, testJob("a", structs.PriorityNormal, "v1:1"), testJob("b", structs.PriorityNormal, "v2:1"))
+
+		claim(t, s, "a1", testNow)
+		status, _, err := s.Fail(ctx, "a", "a1", transient, testNow)
+		expectStatus(t, "first transient failure", status, err, "queue")
+		expectLastEvent(t, s, "a", structs.EventAttemptFailed, structs.StateQueued)
+
+		// b is claimed first since a went back to the end of the queue
+		claim(t, s, "b1", testNow)
+		status, _, err = s.Fail(ctx, "b", "b1", Failure{Error: "private", Class: structs.ClassPermanent}, testNow)
+		expectStatus(t, "permanent failure", status, err, "ok")
+		expectState(t, s, "b", structs.StateFail)
+		expectLastEvent(t, s, "b", structs.EventFailed, structs.StateFail)
+
+		claim(t, s, "a2", testNow)
+		status, _, err = s.Fail(ctx, "a", "a2", transient, testNow)
+		expectStatus(t, "transient failure after the last retry", status, err, "ok")
+		expectState(t, s, "a", structs.StateFail)
+		expectLastEvent(t, s, "a", structs.EventFailed, structs.StateFail)
+
+		video, err := s.Lookup(ctx, "a")
+		if err != nil || video.Meta["last_error"] != "timeout" || video.Meta["retries"] != "2" {
+			t.Fatalf("Lookup(a) = %+v, %v", video, err)
+		}
+
+		status, err = s.Retry(ctx, "a", true, testNow)
+		expectStatus(t, "Retry", status, err, "ok")
+		status, err = s.Retry(ctx, "a", true, testNow)
+		expectStatus(t, "Retry twice", status, err, "not_failed")
+		status, err = s.Retry(ctx, "unknown", true, testNow)
+		expectStatus(t, "Retry an unknown job", status, err, "missing")
+		if got := claim(t, s, "a3", testNow); got != "a" {
+			t.Fatalf("claimed %q after retry, want a", got)
+		}
+	})
+}
+
+func TestFailSchedulesBackoff(t *testing.T) {
+	config := testConfig
+	config.RetryPolicy = backoff.Policy{Base: time.Minute, Multiplier: 2}
+	forEachStore(t, config, func(t *testing.T, s Store) {
+		enqueue(t, s, testJob("a", structs.PriorityNormal, "v1:1"))
+		claim(t, s, "a1", testNow)
+
+		status, nextAttemptAt, err := s.Fail(context.Background(), "a", "a1", Failure{Class: structs.ClassTransient}, testNow)
+		expectStatus(t, "transient failure", status, err, "scheduled")
+		if want := testNow.Add(time.Minute).Unix(); nextAttemptAt != want {
+			t.Fatalf("next attempt at %d, want %d", nextAttemptAt, want)
+		}
+		expectState(t, s, "a", structs.StateScheduled)
+	})
+}
+
+func TestRecover(t *testing.T) {
+	forEachStore(t, testConfig, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		enqueue(t, s, testJob("a", structs.PriorityNormal, "v1:1"))
+		claim(t, s, "a1", testNow)
+
+		recovered, err := s.Recover(ctx, testNow)
+		if err != nil || len(recovered) != 0 {
+			t.Fatalf("Recover before the lease expired = %+v, %v", recovered, err)
+		}
+
+		expired := testNow.Add(2 * time.Minute)
+		recovered, err = s.Recover(ctx, expired)
+		if err != nil || len(recovered) != 1 || recovered[0].Status != "queue" {
+			t.Fatalf("Recover = %+v, %v, want a queued", recovered, err)
+		}
+		expectLastEvent(t, s, "a", structs.EventTimedOut, structs.StateQueued)
+		status, err := s.Complete(ctx, "a", "a1", expired)
+		expectStatus(t, "Complete after the lease was lost", status, err, "stale")
+
+		claim(t, s, "a2", expired)
+		recovered, err = s.Recover(ctx, expired.Add(2*time.Minute))
+		if err != nil || len(recovered) != 1 || recovered[0].Status != "fail" {
+			t.Fatalf("Recover after the last retry = %+v, %v, want a failed", recovered, err)
+		}
+		expectState(t, s, "a", structs.StateFail)
+		expectLastEvent(t, s, "a", structs.EventFailed, structs.StateFail)
+	})
+}
+
+func TestCancel(t *testing.T) {
+	forEachStore(t, testConfig, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		enqueue(t, s, testJob("wip", structs.PriorityNormal, "v1:1"), testJob("queued", structs.PriorityNormal, "v2:1"))
+		claim(t, s, "token", testNow)
+
+		status, err := s.Cancel(ctx, "queued", testNow)
+		expectStatus(t, "Cancel a queued job", status, err, "deleted")
+		status, err = s.Cancel(ctx, "queued", testNow)
+		expectStatus(t, "Cancel a deleted job", status, err, "missing")
+
+		status, err = s.Cancel(ctx, "wip", testNow)
+		expectStatus(t, "Cancel a job in progress", status, err, "cancelling")
+		status, _, err = s.Heartbeat(ctx, "wip", "token", "", testNow)
+		expectStatus(t, "Heartbeat after cancel", status, err, "cancelled")
+		status, err = s.Complete(ctx, "wip", "token", testNow)
+		expectStatus(t, "Complete after cancel", status, err, "cancelled")
+
+		video, err := s.Lookup(ctx, "wip")
+		if err != nil || video != nil {
+			t.Fatalf("Lookup of a cancelled job = %+v, %v", video, err)
+		}
+		// The duplicate index entry is freed
+		if results := enqueue(t, s, testJob("again", structs.PriorityNormal, "v1:1")); results[0].Duplicate {
+			t.Fatalf("cancelled job still counts as a duplicate")
+		}
+
+		claim(t, s, "again", testNow)
+		status, err = s.Complete(ctx, "again", "again", testNow)
+		expectStatus(t, "Complete", status, err, "ok")
+		status, err = s.Cancel(ctx, "again", testNow)
+		expectStatus(t, "Cancel a finished job", status, err, "finished")
+	})
+}
+
+func TestExpandProgress(t *testing.T) {
+	forEachStore(t, testConfig, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		enqueue(t, s, testJob("parent", structs.PriorityNormal, "list:1"))
+		claim(t, s, "p1", testNow)
+
+		status, results, err := s.Expand(ctx, "parent", "p1", []*Job{
+			testJob("done", structs.PriorityNormal, "v1:1"),
+			testJob("failed", structs.PriorityNormal, "v2:1"),
+			testJob("cancelled", structs.PriorityNormal, "v3:1"),
+			testJob("duplicate", structs.PriorityNormal, "v1:1"),
+		}, testNow)
+		expectStatus(t, "Expand", status, err, "ok")
+		if !results[3].Duplicate {
+			t.Fatalf("duplicate child = %+v", results[3])
+		}
+
+		claim(t, s, "c1", testNow)
+		status, err = s.Complete(ctx, "done", "c1", testNow)
+		expectStatus(t, "Complete a child", status, err, "ok")
+		claim(t, s, "c2", testNow)
+		status, _, err = s.Fail(ctx, "failed", "c2", Failure{Error: "private", Class: structs.ClassPermanent}, testNow)
+		expectStatus(t, "Fail a child", status, err, "ok")
+		status, err = s.Cancel(ctx, "cancelled", testNow)
+		expectStatus(t, "Cancel a child", status, err, "deleted")
+
+		video, err := s.Lookup(ctx, "parent")
+		if err != nil {
+			t.Fatalf("Lookup(parent): %v", err)
+		}
+		want := map[string]string{
+			"children_total": "3", "children_duplicate": "1",
+			"children_done": "1", "children_failed": "1", "children_cancelled": "1",
+		}
+		for field, value := range want {
+			if video.Meta[field] != value {
+				t.Fatalf("%s = %q, want %q", field, video.Meta[field], value)
+			}
+		}
+	})
+}
+
+// TestPublishesEvents checks the stores that publish through an
+// events.Publisher instead of from Lua
+func TestPublishesEvents(t *testing.T) {
+	stores := map[string]func(t *testing.T, publish events.Publisher) Store{
+		"memory": func(t *testing.T, publish events.Publisher) Store {
+			return NewMemory(testConfig, publish)
+		},
+		"sqlite": func(t *testing.T, publish events.Publisher) Store {
+			s, err := OpenSQLite(context.Background(), filepath.Join(t.TempDir(), "jobs.db"), testConfig, publish)
+			if err != nil {
+				t.Fatalf("OpenSQLite: %v", err)
+			}
+			t.Cleanup(func() {
+				_ = s.Close()
+			})
+			return s
+		},
+	}
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			var published []structs.VideoEvent
+			s := open(t, func(ctx context.Context, event structs.VideoEvent) error {
+				published = append(published, event)
+				return nil
+			})
+
+			enqueue(t, s, testJob("a", structs.PriorityNormal, "v1:7"), testJob("b", structs.PriorityNormal, "v2:7"))
+			claim(t, s, "a1", testNow)
+			if _, _, err := s.Heartbeat(ctx, "a", "a1", "download", testNow); err != nil {
+				t.Fatalf("Heartbeat: %v", err)
+			}
+			if _, _, err := s.Heartbeat(ctx, "stale", "a1", "download", testNow); err != nil {
+				t.Fatalf("Heartbeat: %v", err)
+			}
+			if _, err := s.Cancel(ctx, "b", testNow); err != nil {
+				t.Fatalf("Cancel: %v", err)
+			}
+
+			want := []struct{ uuid, eventType string }{
+				{"a", structs.EventAdded},
+				{"b", structs.EventAdded},
+				{"a", structs.EventClaimed},
+				{"a", structs.EventProgress},
+				{"b", structs.EventCancelled},
+			}
+			if len(published) != len(want) {
+				t.Fatalf("published %+v, want %v", published, want)
+			}
+			for i, event := range published {
+				if event.Type != want[i].eventType || event.Uuid != want[i].uuid || event.PlaylistId != 7 {
+					t.Fatalf("event %d = %+v, want %s of %s in playlist 7", i, event, want[i].eventType, want[i].uuid)
+				}
+			}
+			if published[3].Stage != "download" {
+				t.Fatalf("progress stage = %q", published[3].Stage)
+			}
+		})
+	}
+}
+
+// TestRedisWaitKeepsPoolFree checks that blocked Waits neither hold the
+// connections of the shared client nor miss a queued video
+func TestRedisWaitKeepsPoolFree(t *testing.T) {
+	ctx := context.Background()
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr(), PoolSize: 1, PoolTimeout: 100 * time.Millisecond})
+	s := NewRedis(rdb, testConfig)
+	t.Cleanup(func() {
+		_ = s.Close()
+		_ = rdb.Close()
+	})
+
+	waits := make(chan error, maxBlockingWaits+1)
+	for range maxBlockingWaits + 1 {
+		go func() {
+			waits <- s.Wait(ctx, 10*time.Second)
+		}()
+	}
+	// The waiter beyond maxBlockingWaits polls instead of blocking
+	select {
+	case err := <-waits:
+		if err != nil {
+			t.Fatalf("Wait: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no Wait returned after the poll interval")
+	}
+
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		t.Fatalf("shared client is blocked by Wait: %v", err)
+	}
+	enqueue(t, s, testJob("a", structs.PriorityNormal, "v1:1"))
+	select {
+	case err := <-waits:
+		if err != nil {
+			t.Fatalf("Wait: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("queueing a video did not wake a Wait")
+	}
+}
+
+func TestListAndPrune(t *testing.T) {
+	forEachStore(t, testConfig, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		enqueue(t, s,
+			testJob("a", structs.PriorityNormal, "v1:1"),
+			testJob("b", structs.PriorityNormal, "v2:2"),
+			testJob("c", structs.PriorityNormal, "v3:1"),
+		)
+
+		page, err := s.List(ctx, structs.StateQueued, ListFilter{Limit: 1, PlaylistId: 1})
+		if err != nil || len(page.Videos) != 1 || page.Videos[0].Uuid != "a" || page.NextCursor == "" {
+			t.Fatalf("first page = %+v, %v", page, err)
+		}
+		page, err = s.List(ctx, structs.StateQueued, ListFilter{Limit: 1, PlaylistId: 1, Cursor: page.NextCursor})
+		if err != nil || len(page.Videos) != 1 || page.Videos[0].Uuid != "c" || page.Videos[0].QueuePosition != 3 {
+			t.Fatalf("second page = %+v, %v", page, err)
+		}
+		if _, err := s.List(ctx, structs.StateDone, ListFilter{Limit: 1, Cursor: "nope"}); err != ErrInvalidCursor {
+			t.Fatalf("List with a bad cursor = %v", err)
+		}
+
+		for i := range 3 {
+			uuid := claim(t, s, "token", testNow)
+			status, err := s.Complete(ctx, uuid, "token", testNow.Add(time.Duration(i)*time.Hour))
+			expectStatus(t, "Complete", status, err, "ok")
+		}
+		page, err = s.List(ctx, structs.StateDone, ListFilter{Limit: 10, From: testNow.Add(time.Hour).Unix()})
+		if err != nil || len(page.Videos) != 2 || page.Videos[0].Uuid != "b" {
+			t.Fatalf("done since an hour = %+v, %v", page, err)
+		}
+
+		pruned, err := s.Prune(ctx, map[string]int64{structs.StateDone: testNow.Add(time.Hour).Unix()}, testNow)
+		if err != nil || pruned[structs.StateDone] != 2 {
+			t.Fatalf("Prune = %v, %v, want 2 done", pruned, err)
+		}
+		stats, err := s.Stats(ctx)
+		if err != nil || stats.Done != 1 || stats.Janitor.DonePruned != 2 || stats.Janitor.LastRunAt != testNow.Unix() {
+			t.Fatalf("Stats after prune = %+v, %v", stats, err)
+		}
+		if videoEvents, err := s.Events(ctx, "a"); err != nil || videoEvents != nil {
+			t.Fatalf("Events of a pruned job = %+v, %v", videoEvents, err)
+		}
+		videoEvents, err := s.Events(ctx, "c")
+		if err != nil || len(videoEvents) != 3 || videoEvents[2].Type != structs.EventDone {
+			t.Fatalf("Events(c) = %+v, %v", videoEvents, err)
+		}
+	})
+}
@@ -1,17 +1,123 @@
 package structs
 
+// Video states as reported by the API
+const (
+	StateQueued    = "queued"
+	StateScheduled = "scheduled"
+	StateWip       = "wip"
+	StateDone      = "done"
+	StateFail      = "fail"
+	StateUnknown   = "unknown"
+)
+
+// Event types recorded in the per-video event log. A failed attempt that will
+// be retried is attempt_failed and an expired lease that will be retried is
+// timed_out. Only a video that failed for good, on its last attempt or because
+// its last lease expired, gets a failed event.
+const (
+	EventAdded           = "added"
+	EventClaimed         = "claimed"
+	EventDone            = "done"
+	EventAttemptFailed   = "attempt_failed"
+	EventFailed          = "failed"
+	EventTimedOut        = "timed_out"
+	EventPromoted        = "promoted"
+	EventRetried         = "retried"
+	EventCancelRequested = "cancel_requested"
+	EventCancelled       = "cancelled"
+	EventExpanded        = "expanded"
+	// EventProgress is only streamed live and not kept in the event log
+	EventProgress = "progress"
+)
+
+var EventTypes = []string{
+	EventAdded, EventClaimed, EventDone, EventAttemptFailed, EventFailed, EventTimedOut, EventPromoted,
+	EventRetried, EventCancelRequested, EventCancelled, EventExpanded, EventProgress,
+}
+
+// Job types. A video job downloads one video, an expand job lists the entries
+// of a YouTube playlist so the server can add a video job for each of them.
+const (
+	JobTypeVideo  = "video"
+	JobTypeExpand = "expand"
+)
+
+// Queue priorities, highest first. Videos of a higher priority are always
+// handed out before lower ones, and FIFO order is kept within a priority.
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+var Priorities = []string{PriorityHigh, PriorityNormal, PriorityLow}
+
+// QueueKey returns the Redis list holding queued videos of the given priority.
+// Normal priority keeps the original videos:queue key.
+func QueueKey(priority string) string {
+	if priority == PriorityNormal || priority == "" {
+		return "videos:queue"
+	}
+	return "videos:queue:" + priority
+}
+
+// QueueKeys returns the queue lists of all priorities, highest first
+func QueueKeys() []string {
+	keys := make([]string, 0, len(Priorities))
+	for _, priority := range Priorities {
+		keys = append(keys, QueueKey(priority))
+	}
+	return keys
+}
+
 type VideoAddRequest struct {
 	VideoUrl   string `json:"videoUrl"`
 	PlaylistId int    `json:"playlistId"`
+	// Priority is one of high, normal or low and defaults to normal
+	Priority string `json:"priority"`
+	// Force queues a new download even if the video was already added to the playlist
+	Force bool `json:"force"`
+	// NotBefore (unix seconds) or Delay (seconds) hold the video back until it is due
+	NotBefore int64 `json:"notBefore"`
+	Delay     int   `json:"delay"`
+}
+
+type VideoAddBatchRequest struct {
+	Items []VideoAddRequest `json:"items"`
+}
+
+// VideoAddResult is the outcome of one item of a batch, in request order.
+// Error is set instead of Uuid when the item was rejected.
+type VideoAddResult struct {
+	Index     int    `json:"index"`
+	Uuid      string `json:"uuid,omitempty"`
+	State     string `json:"state,omitempty"`
+	Duplicate bool   `json:"duplicate"`
+	Error     string `json:"error,omitempty"`
+}
+
+type VideoAddBatchResponse struct {
+	Status     bool             `json:"status"`
+	Added      int              `json:"added"`
+	Duplicates int              `json:"duplicates"`
+	Rejected   int              `json:"rejected"`
+	Results    []VideoAddResult `json:"results"`
 }
 
 type VideoResponse struct {
-	Uuid          string `json:"uuid"`
-	VideoUrl      string `json:"videoUrl"`
-	PlaylistId    int    `json:"playlistId"`
-	Retries       int    `json:"retries"`
-	AddedAt       int64  `json:"addedAt"`
-	LastAttemptAt int64  `json:"lastAttemptAt"`
+	Uuid  string `json:"uuid"`
+	Token string `json:"token"`
+	// Type is video or expand
+	Type           string `json:"type"`
+	VideoUrl       string `json:"videoUrl"`
+	PlaylistId     int    `json:"playlistId"`
+	Priority       string `json:"priority"`
+	Retries        int    `json:"retries"`
+	AddedAt        int64  `json:"addedAt"`
+	LastAttemptAt  int64  `json:"lastAttemptAt"`
+	LeaseExpiresAt int64  `json:"leaseExpiresAt"`
+	// NotBefore is the next time the video is eligible to be claimed, 0 or a past time if it already is
+	NotBefore int64 `json:"notBefore"`
 }
 
 type VideoStore struct {
@@ -20,16 +126,333 @@ type VideoStore struct {
 	PlaylistId int    `json:"playlistId"`
 }
 
+type VideoHeartbeatRequest struct {
+	Uuid  string `json:"uuid"`
+	Token string `json:"token"`
+	// Stage optionally reports the stage the worker just started, which is
+	// streamed to GET /events as a progress event
+	Stage string `json:"stage,omitempty"`
+}
+
+type VideoHeartbeatResponse struct {
+	Status         bool   `json:"status"`
+	Uuid           string `json:"uuid"`
+	LeaseExpiresAt int64  `json:"leaseExpiresAt"`
+}
+
+// Stages a worker can fail in
+const (
+	StageDownload = "download"
+	StageUpload   = "upload"
+	StageAssign   = "assign"
+)
+
+var Stages = []string{StageDownload, StageUpload, StageAssign}
+
+// Failure classes. Transient failures are retried with backoff, permanent ones
+// go straight to the fail set.
+const (
+	ClassTransient = "transient"
+	ClassPermanent = "permanent"
+)
+
 type VideoFailRequest struct {
-	Uuid string `json:"uuid"`
+	Uuid  string `json:"uuid"`
+	Token string `json:"token"`
+	// Error is the failure message, e.g. yt-dlp stderr or the AzuraCast error body
+	Error string `json:"error"`
+	// Stage is one of download, upload or assign
+	Stage string `json:"stage"`
+	// Class is transient or permanent and defaults to permanent
+	Class string `json:"class"`
 }
 type VideoDoneRequest struct {
-	Uuid string `json:"uuid"`
+	Uuid  string `json:"uuid"`
+	Token string `json:"token"`
+}
+
+// MaxExpandEntries caps the number of playlist entries one expand job can add.
+// Workers only report the first entries of longer playlists.
+const MaxExpandEntries = 5000
+
+// VideoExpandRequest completes an expand job with the YouTube video ids of the
+// playlist entries, in playlist order
+type VideoExpandRequest struct {
+	Uuid    string   `json:"uuid"`
+	Token   string   `json:"token"`
+	Entries []string `json:"entries"`
+}
+
+// VideoExpandResponse lists the outcome per entry, in request order
+type VideoExpandResponse struct {
+	Status     bool             `json:"status"`
+	Uuid       string           `json:"uuid"`
+	Added      int              `json:"added"`
+	Duplicates int              `json:"duplicates"`
+	Rejected   int              `json:"rejected"`
+	Results    []VideoAddResult `json:"results"`
+}
+
+// ExpandProgress tracks the videos added by an expand job. Pending videos
+// are still queued, scheduled or in progress.
+type ExpandProgress struct {
+	Total      int `json:"total"`
+	Duplicates int `json:"duplicates"`
+	Done       int `json:"done"`
+	Failed     int `json:"failed"`
+	Cancelled  int `json:"cancelled"`
+	Pending    int `json:"pending"`
+}
+
+// VideoRetryRequest moves failed videos back into the queue. Either Uuids is
+// set, or the filters select videos from the fail set. All must be set to
+// retry every failed video when no filter is given.
+type VideoRetryRequest struct {
+	Uuids      []string `json:"uuids"`
+	PlaylistId int      `json:"playlistId"`
+	Class      string   `json:"class"`
+	From       int64    `json:"from"`
+	To         int64    `json:"to"`
+	All        bool     `json:"all"`
+	// ResetRetries starts the retry counter over instead of keeping it
+	ResetRetries bool `json:"resetRetries"`
+}
+
+type VideoRetryResult struct {
+	Uuid    string `json:"uuid"`
+	Retried bool   `json:"retried"`
+	Message string `json:"message,omitempty"`
+}
+
+type VideoRetryResponse struct {
+	Status  bool `json:"status"`
+	Retried int  `json:"retried"`
+	// Failed counts the videos that could not be retried because of a server
+	// error. The others were still retried.
+	Failed  int                `json:"failed"`
+	Results []VideoRetryResult `json:"results"`
+}
+
+type VideoError struct {
+	Message string `json:"message"`
+	Stage   string `json:"stage"`
+	Class   string `json:"class"`
+	At      int64  `json:"at"`
+}
+
+type VideoDetailResponse struct {
+	Uuid  string `json:"uuid"`
+	State string `json:"state"`
+	// Meta is the stored metadata hash, without the current attempt token and,
+	// unless the caller is an admin, without the IdentityFields
+	Meta map[string]string `json:"meta"`
+	// QueuePosition is 1 for the next video to be claimed, 0 if not queued
+	QueuePosition  int         `json:"queuePosition"`
+	LeaseExpiresAt int64       `json:"leaseExpiresAt"`
+	NotBefore      int64       `json:"notBefore"`
+	Retries        int         `json:"retries"`
+	LastError      *VideoError `json:"lastError"`
+	// Progress is set for expand jobs once they have added their videos
+	Progress *ExpandProgress `json:"progress,omitempty"`
+	// Submitter is set for admins on videos added since submitters are
+	// recorded. Videos added by an expand job inherit its submitter.
+	Submitter *Identity `json:"submitter,omitempty"`
+}
+
+// VideoEvent is one state transition in the history of a video. State is the
+// state the video was left in, the other fields are set where they apply.
+// Uuid and PlaylistId are only set on events streamed from GET /events.
+type VideoEvent struct {
+	Uuid       string `json:"uuid,omitempty"`
+	PlaylistId int    `json:"playlistId,omitempty"`
+	Type       string `json:"type"`
+	At         int64  `json:"at"`
+	State      string `json:"state,omitempty"`
+	Worker     string `json:"worker,omitempty"`
+	Attempt    int    `json:"attempt,omitempty"`
+	Priority   string `json:"priority,omitempty"`
+	NotBefore  int64  `json:"notBefore,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Stage      string `json:"stage,omitempty"`
+	Class      string `json:"class,omitempty"`
+	// Children and Duplicates count the videos an expand job added and skipped
+	Children   int `json:"children,omitempty"`
+	Duplicates int `json:"duplicates,omitempty"`
+}
+
+type VideoEventsResponse struct {
+	Uuid   string       `json:"uuid"`
+	Events []VideoEvent `json:"events"`
+}
+
+type VideoListResponse struct {
+	Videos []*VideoDetailResponse `json:"videos"`
+	// NextCursor is passed as ?cursor= to fetch the next page, empty on the last page
+	NextCursor string `json:"nextCursor"`
 }
 
 type StatusResponse struct {
-	WipCount    int `json:"wipCount"`
-	DoneCount   int `json:"doneCount"`
-	FailCount   int `json:"failCount"`
-	QueueLength int `json:"queueLength"`
+	WipCount        int            `json:"wipCount"`
+	DoneCount       int            `json:"doneCount"`
+	FailCount       int            `json:"failCount"`
+	QueueLength     int            `json:"queueLength"`
+	QueueByPriority map[string]int `json:"queueByPriority"`
+	ScheduledCount  int            `json:"scheduledCount"`
+	Janitor         JanitorStatus  `json:"janitor"`
+	Providers       []string       `json:"providers"`
+}
+
+// JanitorStatus reports how many finished videos the retention janitor removed,
+// in total and in its last run
+type JanitorStatus struct {
+	LastRunAt      int64 `json:"lastRunAt,omitempty"`
+	DonePruned     int   `json:"donePruned"`
+	FailPruned     int   `json:"failPruned"`
+	LastDonePruned int   `json:"lastDonePruned"`
+	LastFailPruned int   `json:"lastFailPruned"`
+}
+
+// WebhookRequest subscribes a URL to video events. Events defaults to done and
+// failed, and a secret is generated when none is given.
+type WebhookRequest struct {
+	Url    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+// Webhook is a subscription. The secret is only returned when it is created.
+type Webhook struct {
+	Id        string   `json:"id"`
+	Url       string   `json:"url"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"secret,omitempty"`
+	CreatedAt int64    `json:"createdAt"`
+}
+
+type WebhookListResponse struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+// Webhook delivery states
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookPayload is the signed JSON body posted to a webhook. Video is the
+// metadata of the video at the time of the event, without the IdentityFields.
+type WebhookPayload struct {
+	DeliveryId string            `json:"deliveryId"`
+	Event      VideoEvent        `json:"event"`
+	Video      map[string]string `json:"video"`
+}
+
+type WebhookDelivery struct {
+	Id             string `json:"id"`
+	WebhookId      string `json:"webhookId"`
+	Event          string `json:"event"`
+	Uuid           string `json:"uuid"`
+	Status         string `json:"status"`
+	Attempts       int    `json:"attempts"`
+	LastStatusCode int    `json:"lastStatusCode,omitempty"`
+	LastError      string `json:"lastError,omitempty"`
+	CreatedAt      int64  `json:"createdAt"`
+	LastAttemptAt  int64  `json:"lastAttemptAt,omitempty"`
+	NextAttemptAt  int64  `json:"nextAttemptAt,omitempty"`
+	DeliveredAt    int64  `json:"deliveredAt,omitempty"`
+}
+
+type WebhookDeliveriesResponse struct {
+	WebhookId  string            `json:"webhookId"`
+	Deliveries []WebhookDelivery `json:"deliveries"`
+}
+
+// Token scopes. A token may only call the routes that require one of its
+// scopes, and admin may call every route.
+const (
+	ScopeSubmit = "submit"
+	ScopeWorker = "worker"
+	ScopeRead   = "read"
+	ScopeAdmin  = "admin"
+)
+
+var Scopes = []string{ScopeSubmit, ScopeWorker, ScopeRead, ScopeAdmin}
+
+// TokenRequest creates a named API token. ExpiresIn (seconds) is optional, a
+// token without it never expires. DailyQuota and WeeklyQuota override the
+// server's submission quotas for the token.
+type TokenRequest struct {
+	Name        string   `json:"name"`
+	Scopes      []string `json:"scopes"`
+	ExpiresIn   int64    `json:"expiresIn"`
+	DailyQuota  int      `json:"dailyQuota"`
+	WeeklyQuota int      `json:"weeklyQuota"`
+}
+
+// Token is a named API token. The secret is only returned when it is created.
+type Token struct {
+	Id          string   `json:"id"`
+	Name        string   `json:"name"`
+	Scopes      []string `json:"scopes"`
+	Secret      string   `json:"secret,omitempty"`
+	CreatedAt   int64    `json:"createdAt"`
+	ExpiresAt   int64    `json:"expiresAt,omitempty"`
+	RevokedAt   int64    `json:"revokedAt,omitempty"`
+	DailyQuota  int      `json:"dailyQuota,omitempty"`
+	WeeklyQuota int      `json:"weeklyQuota,omitempty"`
+}
+
+type TokenListResponse struct {
+	Tokens []Token `json:"tokens"`
+}
+
+// Client types, sent by first party clients in the X-Firecast-Client header.
+// Requests without it are from the API.
+const (
+	ClientExtension = "extension"
+	ClientCLI       = "cli"
+	ClientAPI       = "api"
+)
+
+// Identity is who made a request and from where. Name is the name of the token,
+// or "secret" for FIRECAST_SECRET.
+type Identity struct {
+	Name      string `json:"name"`
+	TokenId   string `json:"tokenId,omitempty"`
+	Client    string `json:"client"`
+	RequestId string `json:"requestId,omitempty"`
+	SourceIp  string `json:"sourceIp,omitempty"`
+}
+
+// IdentityFields are the metadata fields recording the submitter of a video.
+// Only admin tokens get to see them, they are left out everywhere else.
+var IdentityFields = []string{"submitted_by", "submitter_token", "client", "request_id", "source_ip"}
+
+// Audit log actions
+const (
+	AuditVideoRetry    = "video.retry"
+	AuditVideoCancel   = "video.cancel"
+	AuditTokenCreate   = "token.create"
+	AuditTokenRevoke   = "token.revoke"
+	AuditWebhookCreate = "webhook.create"
+	AuditWebhookDelete = "webhook.delete"
+)
+
+// AuditEntry records one administrative action. Id is its position in the
+// append-only log, Target the uuid of the video or id of the token or webhook
+// it acted on.
+type AuditEntry struct {
+	Id      int64             `json:"id"`
+	At      int64             `json:"at"`
+	Action  string            `json:"action"`
+	Actor   Identity          `json:"actor"`
+	Target  string            `json:"target"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+type AuditListResponse struct {
+	Entries []AuditEntry `json:"entries"`
+	// NextCursor is passed as ?cursor= to fetch older entries, empty on the last page
+	NextCursor string `json:"nextCursor"`
 }
@@ -0,0 +1,97 @@
+package tokens
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"firecast/pkg/structs"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// SetKey holds the ids of all tokens, revoked ones included
+	SetKey = "tokens"
+	// IndexKey maps the hash of every active secret to the id of its token
+	IndexKey = "tokens:index"
+)
+
+var (
+	ErrInvalid = errors.New("invalid token")
+	ErrExpired = errors.New("token expired")
+)
+
+// TokenKey returns the hash holding a token
+func TokenKey(id string) string {
+	return fmt.Sprintf("tokens:token:%s", id)
+}
+
+// Hash returns the hex SHA-256 of a secret. Only hashes are stored, so a
+// secret cannot be read back from Redis.
+func Hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// FromHash builds a token from its Redis hash
+func FromHash(id string, token map[string]string) structs.Token {
+	createdAt, _ := strconv.ParseInt(token["created_at"], 10, 64)
+	expiresAt, _ := strconv.ParseInt(token["expires_at"], 10, 64)
+	revokedAt, _ := strconv.ParseInt(token["revoked_at"], 10, 64)
+	dailyQuota, _ := strconv.Atoi(token["daily_quota"])
+	weeklyQuota, _ := strconv.Atoi(token["weekly_quota"])
+	return structs.Token{
+		Id:          id,
+		Name:        token["name"],
+		Scopes:      strings.Split(token["scopes"], ","),
+		CreatedAt:   createdAt,
+		ExpiresAt:   expiresAt,
+		RevokedAt:   revokedAt,
+		DailyQuota:  dailyQuota,
+		WeeklyQuota: weeklyQuota,
+	}
+}
+
+// Lookup returns the active token a secret belongs to, or ErrInvalid if there
+// is none and ErrExpired if it expired. Revoked tokens are invalid.
+func Lookup(ctx context.Context, rdb *redis.Client, secret string, now time.Time) (*structs.Token, error) {
+	id, err := rdb.HGet(ctx, IndexKey, Hash(secret)).Result()
+	if err == redis.Nil {
+		return nil, ErrInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := Get(ctx, rdb, id)
+	if err != nil {
+		return nil, err
+	}
+	if token == nil || token.RevokedAt > 0 {
+		return nil, ErrInvalid
+	}
+	if token.ExpiresAt > 0 && token.ExpiresAt <= now.Unix() {
+		return nil, ErrExpired
+	}
+	return token, nil
+}
+
+// Get returns the token with an id, revoked and expired ones included, or nil
+// if there is none
+func Get(ctx context.Context, rdb *redis.Client, id string) (*structs.Token, error) {
+	hash, err := rdb.HGetAll(ctx, TokenKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(hash) == 0 {
+		return nil, nil
+	}
+	token := FromHash(id, hash)
+	return &token, nil
+}
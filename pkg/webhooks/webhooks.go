@@ -0,0 +1,366 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"firecast/pkg/backoff"
+	"firecast/pkg/store"
+	"firecast/pkg/structs"
+
+	"github.com/joho/godotenv"
+	"github.com/lithammer/shortuuid/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// logLength is how many deliveries are kept in the log of each webhook
+	logLength = 100
+	// deliveryRetention is how long a finished delivery stays readable in the log
+	deliveryRetention = 7 * 24 * time.Hour
+	batchSize         = 100
+	// fanOutLease is how long an event popped from the outbox is left to one
+	// dispatcher before another one fans it out instead
+	fanOutLease = time.Minute
+)
+
+// retryPolicy spaces out the attempts to deliver to an unreachable receiver
+var retryPolicy = backoff.Policy{
+	Base:       10 * time.Second,
+	Multiplier: 2,
+	Max:        30 * time.Minute,
+	Jitter:     0.2,
+}
+
+// HookKey returns the hash holding a webhook subscription
+func HookKey(id string) string {
+	return fmt.Sprintf("webhooks:hook:%s", id)
+}
+
+// LogKey returns the list of delivery ids of a webhook, newest first
+func LogKey(id string) string {
+	return fmt.Sprintf("webhooks:log:%s", id)
+}
+
+// DeliveryKey returns the hash holding the state of one delivery
+func DeliveryKey(id string) string {
+	return fmt.Sprintf("webhooks:delivery:%s", id)
+}
+
+// popScript leases the next event to fan out. An event whose lease expired in
+// webhooks:fanout, because its dispatcher stopped, is taken before a new one is
+// popped from the outbox. Entries are prefixed with an id so equal payloads stay
+// apart.
+// KEYS[1] = webhooks:outbox, KEYS[2] = webhooks:fanout
+// ARGV[1] = now, ARGV[2] = lease deadline, ARGV[3] = id for a popped event
+// Returns the entry, or false if there is nothing to fan out.
+var popScript = redis.NewScript(`
+local entry = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1], 'LIMIT', 0, 1)[1]
+if not entry then
+	local payload = redis.call('LPOP', KEYS[1])
+	if not payload then
+		return false
+	end
+	entry = ARGV[3] .. ':' .. payload
+end
+redis.call('ZADD', KEYS[2], ARGV[2], entry)
+return entry
+`)
+
+// claimScript leases a due delivery to one dispatcher right before it is
+// posted, by moving its score to the lease deadline, so no other dispatcher
+// posts it meanwhile
+// KEYS[1] = webhooks:pending
+// ARGV[1] = delivery id, ARGV[2] = now, ARGV[3] = lease deadline
+// Returns 1 if the delivery was claimed, 0 if it is not due or was claimed already.
+var claimScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not score or tonumber(score) > tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+return 1
+`)
+
+// Sign returns the signature sent in the X-Firecast-Signature header, the hex
+// HMAC-SHA256 of the timestamp, a dot and the body, keyed with the webhook secret
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatcher turns queued video events into deliveries for every webhook that
+// subscribed to them, and posts due deliveries, retrying failed ones with
+// backoff until WEBHOOK_MAX_ATTEMPTS is reached. The metadata sent along with
+// each event is read from jobStore.
+func Dispatcher(ctx context.Context, rdb *redis.Client, jobStore store.Store) {
+
+	err := godotenv.Load()
+	if err != nil {
+		fmt.Println("Error loading .env file - using environment variables")
+	}
+
+	maxAttempts := envInt("WEBHOOK_MAX_ATTEMPTS", 5)
+	dispatchFrequency := envInt("WEBHOOK_INTERVAL", 2)
+	timeout := envInt("WEBHOOK_TIMEOUT", 10)
+
+	client := &http.Client{Timeout: time.Duration(timeout) * time.Second}
+
+	go func() {
+		for {
+			dispatch(ctx, rdb, jobStore, client, maxAttempts, time.Now)
+			time.Sleep(time.Duration(dispatchFrequency) * time.Second)
+		}
+	}()
+}
+
+// dispatch fans out the queued events and posts the deliveries that are due.
+// now is read again before each delivery, as posting a batch takes a while.
+func dispatch(ctx context.Context, rdb *redis.Client, jobStore store.Store, client *http.Client, maxAttempts int, now func() time.Time) {
+	if err := fanOut(ctx, rdb, jobStore, now()); err != nil {
+		log.Printf("Error fanning out webhook events: %v", err)
+	}
+
+	dueDeliveries, err := rdb.ZRangeByScore(ctx, "webhooks:pending", &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now().Unix(), 10),
+		Count: batchSize,
+	}).Result()
+	if err != nil {
+		log.Printf("Error scanning webhooks:pending: %v", err)
+	}
+	for _, deliveryId := range dueDeliveries {
+		if err := deliver(ctx, rdb, client, deliveryId, maxAttempts, now()); err != nil {
+			log.Printf("Error delivering webhook %s: %v", deliveryId, err)
+		}
+	}
+}
+
+// fanOut creates a pending delivery per subscribed webhook for each event in
+// the outbox. Each event is leased to one dispatcher and only leaves
+// webhooks:fanout together with its deliveries, so a crash in between delivers
+// it again rather than losing it.
+func fanOut(ctx context.Context, rdb *redis.Client, jobStore store.Store, now time.Time) error {
+	for range batchSize {
+		entry, err := popScript.Run(ctx, rdb, []string{"webhooks:outbox", "webhooks:fanout"},
+			now.Unix(), now.Add(fanOutLease).Unix(), shortuuid.New(),
+		).Text()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, payload, _ := strings.Cut(entry, ":")
+
+		var event structs.VideoEvent
+		if err := json.Unmarshal([]byte(payload), &event); err != nil {
+			log.Printf("Dropping malformed webhook event: %v", err)
+			if err := rdb.ZRem(ctx, "webhooks:fanout", entry).Err(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		hooks, err := subscribers(ctx, rdb, event.Type)
+		if err != nil {
+			return err
+		}
+		meta := map[string]string{}
+		video, err := jobStore.Lookup(ctx, event.Uuid)
+		if err != nil {
+			return err
+		}
+		if video != nil {
+			meta = video.Meta
+		}
+		// Receivers get the video but not who submitted it
+		delete(meta, "attempt_token")
+		for _, field := range structs.IdentityFields {
+			delete(meta, field)
+		}
+
+		_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, hookId := range hooks {
+				deliveryId := shortuuid.New()
+				body, err := json.Marshal(structs.WebhookPayload{
+					DeliveryId: deliveryId,
+					Event:      event,
+					Video:      meta,
+				})
+				if err != nil {
+					return err
+				}
+
+				pipe.HSet(ctx, DeliveryKey(deliveryId),
+					"webhook_id", hookId,
+					"event", event.Type,
+					"uuid", event.Uuid,
+					"body", body,
+					"status", structs.DeliveryPending,
+					"attempts", 0,
+					"created_at", now.Unix(),
+					"next_attempt_at", now.Unix(),
+				)
+				pipe.ZAdd(ctx, "webhooks:pending", redis.Z{Score: float64(now.Unix()), Member: deliveryId})
+				pipe.LPush(ctx, LogKey(hookId), deliveryId)
+				pipe.LTrim(ctx, LogKey(hookId), 0, logLength-1)
+			}
+			pipe.ZRem(ctx, "webhooks:fanout", entry)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subscribers returns the ids of the webhooks subscribed to an event type
+func subscribers(ctx context.Context, rdb *redis.Client, eventType string) ([]string, error) {
+	ids, err := rdb.SMembers(ctx, "webhooks").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var hooks []string
+	for _, id := range ids {
+		eventsStr, err := rdb.HGet(ctx, HookKey(id), "events").Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(strings.Split(eventsStr, ","), eventType) {
+			hooks = append(hooks, id)
+		}
+	}
+	return hooks, nil
+}
+
+// deliver claims a due delivery, posts it to its webhook and records the
+// outcome. now is the time of this attempt.
+func deliver(ctx context.Context, rdb *redis.Client, client *http.Client, deliveryId string, maxAttempts int, now time.Time) error {
+	// The lease runs out once the request surely timed out, so the delivery is
+	// retried if this dispatcher stops before recording the outcome
+	leaseDeadline := now.Add(client.Timeout + time.Minute).Unix()
+	claimed, err := claimScript.Run(ctx, rdb, []string{"webhooks:pending"}, deliveryId, now.Unix(), leaseDeadline).Int()
+	if err != nil || claimed == 0 {
+		return err
+	}
+
+	delivery, err := rdb.HGetAll(ctx, DeliveryKey(deliveryId)).Result()
+	if err != nil {
+		return err
+	}
+	if len(delivery) == 0 {
+		return rdb.ZRem(ctx, "webhooks:pending", deliveryId).Err()
+	}
+
+	hook, err := rdb.HGetAll(ctx, HookKey(delivery["webhook_id"])).Result()
+	if err != nil {
+		return err
+	}
+	if len(hook) == 0 {
+		return finish(ctx, rdb, deliveryId, structs.DeliveryFailed, "last_error", "Webhook was deleted")
+	}
+
+	attempts, _ := strconv.Atoi(delivery["attempts"])
+	attempts++
+
+	statusCode, deliveryErr := post(ctx, client, hook, delivery, deliveryId)
+	fields := []any{"attempts", attempts, "last_attempt_at", now.Unix(), "last_status_code", statusCode}
+	if deliveryErr == nil {
+		fields = append(fields, "delivered_at", now.Unix(), "last_error", "")
+		return finish(ctx, rdb, deliveryId, structs.DeliveryDelivered, fields...)
+	}
+
+	fields = append(fields, "last_error", deliveryErr.Error())
+	if attempts >= maxAttempts {
+		log.Printf("Webhook delivery %s failed after %d attempts: %v", deliveryId, attempts, deliveryErr)
+		return finish(ctx, rdb, deliveryId, structs.DeliveryFailed, fields...)
+	}
+
+	nextAttemptAt := retryPolicy.NextAttemptAt(now, attempts).Unix()
+	fields = append(fields, "next_attempt_at", nextAttemptAt)
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, DeliveryKey(deliveryId), fields...)
+		pipe.ZAdd(ctx, "webhooks:pending", redis.Z{Score: float64(nextAttemptAt), Member: deliveryId})
+		return nil
+	})
+	return err
+}
+
+// post sends the signed payload and treats any 2xx answer as delivered
+func post(ctx context.Context, client *http.Client, hook, delivery map[string]string, deliveryId string) (int, error) {
+	body := []byte(delivery["body"])
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", hook["url"], bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "firecast-webhooks")
+	req.Header.Set("X-Firecast-Event", delivery["event"])
+	req.Header.Set("X-Firecast-Delivery", deliveryId)
+	req.Header.Set("X-Firecast-Timestamp", timestamp)
+	req.Header.Set("X-Firecast-Signature", Sign(hook["secret"], timestamp, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send request: %v", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Printf("Warning: failed to close response body: %v", err)
+		}
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp.StatusCode, fmt.Errorf("receiver returned %d: %s", resp.StatusCode, string(respBody))
+	}
+	return resp.StatusCode, nil
+}
+
+// finish records the final state of a delivery and lets it expire from the log
+func finish(ctx context.Context, rdb *redis.Client, deliveryId, status string, fields ...any) error {
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, DeliveryKey(deliveryId), append(fields, "status", status, "next_attempt_at", 0)...)
+		pipe.Expire(ctx, DeliveryKey(deliveryId), deliveryRetention)
+		pipe.ZRem(ctx, "webhooks:pending", deliveryId)
+		return nil
+	})
+	return err
+}
+
+func envInt(name string, fallback int) int {
+	valueStr := os.Getenv(name)
+	if valueStr == "" {
+		return fallback
+	}
+	value, err := strconv.Atoi(valueStr)
+	if err != nil || value <= 0 {
+		log.Printf("Invalid %s value: %s, using default %d", name, valueStr, fallback)
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,242 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"firecast/pkg/store"
+	"firecast/pkg/structs"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+var testNow = time.Unix(1_700_000_000, 0)
+
+// at returns a clock that stands still at t
+func at(t time.Time) func() time.Time {
+	return func() time.Time {
+		return t
+	}
+}
+
+// receiver is a webhook endpoint that answers with the given status codes in
+// turn and records every request it got
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.requests = append(rc.requests, r)
+	rc.bodies = append(rc.bodies, body)
+	w.WriteHeader(rc.statuses[min(len(rc.requests), len(rc.statuses))-1])
+}
+
+// setup registers a webhook for done events and queues the done event of a
+// stored video in the outbox
+func setup(t *testing.T, url string) (*redis.Client, store.Store) {
+	t.Helper()
+	ctx := context.Background()
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() {
+		_ = rdb.Close()
+	})
+
+	jobStore := store.NewMemory(store.Config{LeaseDuration: time.Minute}, nil)
+	_, err := jobStore.Enqueue(ctx, []*store.Job{{
+		Uuid:       "video",
+		Priority:   structs.PriorityNormal,
+		IndexField: "v1:1",
+		Meta: []interface{}{
+			"video_id", "v1",
+			"playlist_id", 1,
+			"priority", structs.PriorityNormal,
+			"submitted_by", "alice",
+			"source_ip", "192.0.2.1",
+		},
+	}}, testNow)
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	rdb.SAdd(ctx, "webhooks", "hook")
+	rdb.HSet(ctx, HookKey("hook"), "url", url, "secret", "s3cret", "events", structs.EventDone)
+	payload, _ := json.Marshal(structs.VideoEvent{Uuid: "video", PlaylistId: 1, Type: structs.EventDone, At: testNow.Unix()})
+	rdb.RPush(ctx, "webhooks:outbox", payload)
+	return rdb, jobStore
+}
+
+func TestDeliveryRetriesUntilAccepted(t *testing.T) {
+	ctx := context.Background()
+	rc := &receiver{statuses: []int{http.StatusInternalServerError, http.StatusOK}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+	rdb, jobStore := setup(t, server.URL)
+
+	dispatch(ctx, rdb, jobStore, server.Client(), 5, at(testNow))
+	// The failed delivery is not due again until its backoff has passed
+	dispatch(ctx, rdb, jobStore, server.Client(), 5, at(testNow))
+	if len(rc.requests) != 1 {
+		t.Fatalf("receiver got %d requests before the backoff passed, want 1", len(rc.requests))
+	}
+
+	deliveryIds, err := rdb.LRange(ctx, LogKey("hook"), 0, -1).Result()
+	if err != nil || len(deliveryIds) != 1 {
+		t.Fatalf("delivery log = %v, %v, want one delivery", deliveryIds, err)
+	}
+	deliveryId := deliveryIds[0]
+	delivery := rdb.HGetAll(ctx, DeliveryKey(deliveryId)).Val()
+	if delivery["status"] != structs.DeliveryPending || delivery["attempts"] != "1" || delivery["last_status_code"] != "500" {
+		t.Fatalf("delivery after the first attempt = %v", delivery)
+	}
+
+	dispatch(ctx, rdb, jobStore, server.Client(), 5, at(testNow.Add(time.Hour)))
+	delivery = rdb.HGetAll(ctx, DeliveryKey(deliveryId)).Val()
+	if delivery["status"] != structs.DeliveryDelivered || delivery["attempts"] != "2" || delivery["last_status_code"] != "200" {
+		t.Fatalf("delivery after the second attempt = %v", delivery)
+	}
+	if pending := rdb.ZCard(ctx, "webhooks:pending").Val(); pending != 0 {
+		t.Fatalf("%d deliveries still pending", pending)
+	}
+
+	for i, r := range rc.requests {
+		timestamp := r.Header.Get("X-Firecast-Timestamp")
+		if got, want := r.Header.Get("X-Firecast-Signature"), Sign("s3cret", timestamp, rc.bodies[i]); got != want {
+			t.Fatalf("request %d signature = %q, want %q", i, got, want)
+		}
+		if r.Header.Get("X-Firecast-Delivery") != deliveryId || r.Header.Get("X-Firecast-Event") != structs.EventDone {
+			t.Fatalf("request %d headers = %v", i, r.Header)
+		}
+	}
+
+	var payload structs.WebhookPayload
+	if err := json.Unmarshal(rc.bodies[1], &payload); err != nil {
+		t.Fatalf("invalid payload: %v", err)
+	}
+	if payload.DeliveryId != deliveryId || payload.Event.Uuid != "video" || payload.Video["video_id"] != "v1" {
+		t.Fatalf("payload = %+v", payload)
+	}
+	for _, field := range structs.IdentityFields {
+		if _, ok := payload.Video[field]; ok {
+			t.Fatalf("payload carries the identity field %s", field)
+		}
+	}
+}
+
+func TestDeliveryGivesUp(t *testing.T) {
+	ctx := context.Background()
+	rc := &receiver{statuses: []int{http.StatusBadGateway}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+	rdb, jobStore := setup(t, server.URL)
+
+	dispatch(ctx, rdb, jobStore, server.Client(), 2, at(testNow))
+	dispatch(ctx, rdb, jobStore, server.Client(), 2, at(testNow.Add(time.Hour)))
+	dispatch(ctx, rdb, jobStore, server.Client(), 2, at(testNow.Add(2*time.Hour)))
+
+	if len(rc.requests) != 2 {
+		t.Fatalf("receiver got %d requests, want 2", len(rc.requests))
+	}
+	deliveryId := rdb.LIndex(ctx, LogKey("hook"), 0).Val()
+	delivery := rdb.HGetAll(ctx, DeliveryKey(deliveryId)).Val()
+	if delivery["status"] != structs.DeliveryFailed || delivery["attempts"] != "2" || delivery["last_status_code"] != "502" {
+		t.Fatalf("delivery = %v", delivery)
+	}
+}
+
+func TestEventsAndDeliveriesAreClaimedOnce(t *testing.T) {
+	ctx := context.Background()
+	rdb, jobStore := setup(t, "http://127.0.0.1:0")
+
+	entry, err := popScript.Run(ctx, rdb, []string{"webhooks:outbox", "webhooks:fanout"}, testNow.Unix(), testNow.Add(fanOutLease).Unix(), "a").Text()
+	if err != nil {
+		t.Fatalf("pop: %v", err)
+	}
+	// Another dispatcher finds nothing until the lease of the popped event expires
+	if err := popScript.Run(ctx, rdb, []string{"webhooks:outbox", "webhooks:fanout"}, testNow.Unix(), testNow.Add(fanOutLease).Unix(), "b").Err(); err != redis.Nil {
+		t.Fatalf("second pop = %v, want nothing", err)
+	}
+	expired := testNow.Add(2 * fanOutLease)
+	if err := fanOut(ctx, rdb, jobStore, expired); err != nil {
+		t.Fatalf("fanOut: %v", err)
+	}
+	if rdb.ZScore(ctx, "webhooks:fanout", entry).Err() != redis.Nil {
+		t.Fatalf("fanned out event %q was not removed", entry)
+	}
+
+	deliveryId := rdb.LIndex(ctx, LogKey("hook"), 0).Val()
+	claim := func() int {
+		claimed, err := claimScript.Run(ctx, rdb, []string{"webhooks:pending"}, deliveryId, expired.Unix(), expired.Add(time.Minute).Unix()).Int()
+		if err != nil {
+			t.Fatalf("claim: %v", err)
+		}
+		return claimed
+	}
+	if claimed := claim(); claimed != 1 {
+		t.Fatalf("first claim = %d, want 1", claimed)
+	}
+	if claimed := claim(); claimed != 0 {
+		t.Fatalf("second claim = %d, want 0", claimed)
+	}
+}
+
+func TestDeliveriesAreLeasedWhenPosted(t *testing.T) {
+	ctx := context.Background()
+	rc := &receiver{statuses: []int{http.StatusInternalServerError}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+	rdb, jobStore := setup(t, server.URL)
+	rdb.SAdd(ctx, "webhooks", "second")
+	rdb.HSet(ctx, HookKey("second"), "url", server.URL, "secret", "s3cret", "events", structs.EventDone)
+
+	// Every reading of the clock is a minute later, like a slow batch
+	clock := testNow
+	tick := func() time.Time {
+		clock = clock.Add(time.Minute)
+		return clock
+	}
+	dispatch(ctx, rdb, jobStore, server.Client(), 5, tick)
+	if len(rc.requests) != 2 {
+		t.Fatalf("receiver got %d requests, want 2", len(rc.requests))
+	}
+
+	// Each attempt is recorded at the time it was made, and backs off from it
+	lastAttempts := map[int64]bool{}
+	for _, hookId := range []string{"hook", "second"} {
+		deliveryId := rdb.LIndex(ctx, LogKey(hookId), 0).Val()
+		delivery := rdb.HGetAll(ctx, DeliveryKey(deliveryId)).Val()
+		lastAttemptAt, _ := strconv.ParseInt(delivery["last_attempt_at"], 10, 64)
+		nextAttemptAt, _ := strconv.ParseInt(delivery["next_attempt_at"], 10, 64)
+		lastAttempts[lastAttemptAt] = true
+		if nextAttemptAt <= lastAttemptAt {
+			t.Fatalf("delivery of %s backs off from %d to %d", hookId, lastAttemptAt, nextAttemptAt)
+		}
+	}
+	if len(lastAttempts) != 2 {
+		t.Fatalf("both deliveries were attempted at %v", lastAttempts)
+	}
+
+	// A delivery leased by another dispatcher is not posted again
+	deliveryId := rdb.LIndex(ctx, LogKey("hook"), 0).Val()
+	later := clock.Add(time.Hour)
+	rdb.ZAdd(ctx, "webhooks:pending", redis.Z{Score: float64(later.Add(time.Minute).Unix()), Member: deliveryId})
+	if err := deliver(ctx, rdb, server.Client(), deliveryId, 5, later); err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	if len(rc.requests) != 2 {
+		t.Fatalf("a delivery leased elsewhere was posted")
+	}
+}
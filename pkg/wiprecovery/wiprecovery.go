@@ -8,37 +8,20 @@ import (
 	"strconv"
 	"time"
 
+	"firecast/pkg/store"
+
 	"github.com/joho/godotenv"
-	"github.com/redis/go-redis/v9"
 )
 
-func WipRecovery(ctx context.Context, rdb *redis.Client) {
+// WipRecovery periodically takes videos whose lease expired away from their
+// workers. They are retried with backoff, or failed once they used up their retries.
+func WipRecovery(ctx context.Context, jobStore store.Store) {
 
 	err := godotenv.Load()
 	if err != nil {
 		fmt.Println("Error loading .env file - using environment variables")
 	}
 
-	wipTimeoutStr := os.Getenv("WIP_TIMEOUT")
-	if wipTimeoutStr == "" {
-		wipTimeoutStr = "300"
-	}
-	wipTimeout, err := strconv.Atoi(wipTimeoutStr)
-	if err != nil {
-		log.Printf("Invalid WIP_TIMEOUT value: %s, using default 300", wipTimeoutStr)
-		wipTimeout = 300
-	}
-
-	wipRetryStr := os.Getenv("WIP_RETRY")
-	if wipRetryStr == "" {
-		wipRetryStr = "3"
-	}
-	maxRetries, err := strconv.Atoi(wipRetryStr)
-	if err != nil {
-		log.Printf("Invalid WIP_RETRY value: %s, using default 3", wipRetryStr)
-		maxRetries = 3
-	}
-
 	wipFrequencyStr := os.Getenv("WIP_INTERVAL")
 	if wipFrequencyStr == "" {
 		wipFrequencyStr = "10"
@@ -51,46 +34,17 @@ func WipRecovery(ctx context.Context, rdb *redis.Client) {
 
 	go func() {
 		for {
-			now := float64(time.Now().Unix())
-			timeoutThreshold := now - float64(wipTimeout)
-
-			wipVideos, err := rdb.ZRangeByScoreWithScores(ctx, "videos:wip", &redis.ZRangeBy{
-				Min: "-inf",
-				Max: fmt.Sprintf("%f", timeoutThreshold),
-			}).Result()
+			recovered, err := jobStore.Recover(ctx, time.Now())
 			if err != nil {
-				log.Printf("Error scanning videos:wip: %v", err)
-				time.Sleep(time.Duration(wipFrequency) * time.Second)
-				continue
+				log.Printf("Error recovering videos from wip: %v", err)
 			}
 
-			for _, z := range wipVideos {
-				videoUuid := z.Member.(string)
-				metaKey := fmt.Sprintf("videos:meta:%s", videoUuid)
-				videoMeta, err := rdb.HGetAll(ctx, metaKey).Result()
-				if err != nil {
-					log.Printf("Error getting meta for %s: %v", videoUuid, err)
-					continue
-				}
-				retries, _ := strconv.Atoi(videoMeta["retries"])
-
-				_, err = rdb.ZRem(ctx, "videos:wip", videoUuid).Result()
-				if err != nil {
-					log.Printf("Error removing %s from wip: %v", videoUuid, err)
-					continue
-				}
-
-				if retries >= maxRetries {
-					_, err := rdb.SAdd(ctx, "videos:fail", videoUuid).Result()
-					if err != nil {
-						log.Printf("Error moving %s to fail set: %v", videoUuid, err)
-					}
-				} else {
-					_, err := rdb.LPush(ctx, "videos:queue", videoUuid).Result()
-					if err != nil {
-						log.Printf("Error moving %s back to queue: %v", videoUuid, err)
-					}
-					rdb.HSet(ctx, metaKey, "last_attempt_at", time.Now().Unix())
+			for _, recovery := range recovered {
+				switch recovery.Status {
+				case "fail":
+					log.Printf("Video %s exceeded its retries, moved to fail set", recovery.Uuid)
+				case "scheduled":
+					log.Printf("Video %s timed out, retrying after %s", recovery.Uuid, time.Unix(recovery.NotBefore, 0).Format(time.RFC3339))
 				}
 			}
 